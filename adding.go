@@ -1,19 +1,75 @@
 package khatru
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/fiatjaf/eventstore"
 	"github.com/nbd-wtf/go-nostr"
 )
 
 // AddEvent sends an event through then normal add pipeline, as if it was received from a websocket.
-func (rl *Relay) AddEvent(ctx context.Context, evt *nostr.Event) error {
+func (rl *Relay) AddEvent(ctx context.Context, evt *nostr.Event) (err error) {
 	if evt == nil {
 		return errors.New("error: event is nil")
 	}
+	defer func() { rl.recordThroughput(err == nil) }()
+
+	if rl.ReadOnly && isFromClient(ctx) {
+		return errors.New("blocked: this relay is read-only")
+	}
+
+	// if the same event is being added right now (usually sent by two clients at once) this one
+	// is a duplicate, so it's neither stored nor broadcasted twice
+	if _, busy := rl.eventsInFlight.LoadOrStore(evt.ID, struct{}{}); busy {
+		return &Rejection{PrefixDuplicate, "already have this event"}
+	}
+	defer rl.eventsInFlight.Delete(evt.ID)
+
+	if _, ok := ctx.Value(receivedAtKey).(time.Time); !ok {
+		ctx = context.WithValue(ctx, receivedAtKey, time.Now())
+	}
+
+	if isFromClient(ctx) {
+		if difficulty := rl.minPOW(ctx); difficulty > 0 {
+			if err := checkPOW(evt, difficulty); err != nil {
+				return err
+			}
+		}
+	}
+
+	if 30000 <= evt.Kind && evt.Kind < 40000 {
+		// parameterized replaceable events are keyed on their "d" tag, so it must be unambiguous
+		dtags := 0
+		for _, tag := range evt.Tags {
+			if len(tag) >= 1 && tag[0] == "d" {
+				if len(tag) < 2 {
+					return errors.New("invalid: addressable event has a malformed d tag")
+				}
+				dtags++
+			}
+		}
+		if dtags != 1 {
+			return errors.New("invalid: addressable event must have exactly one d tag")
+		}
+	}
+
+	if rl.MaxReplaceableFutureDrift > 0 && isReplaceable(evt.Kind) && rl.tooFarInTheFuture(evt) {
+		return errors.New("invalid: replaceable event too far in the future")
+	}
+
+	if rl.EnableNIP40 && isExpired(evt) {
+		return errors.New("invalid: event already expired")
+	}
+
+	if rl.ResolveDelegation {
+		if _, err := GetDelegator(evt); err != nil {
+			return errors.New("invalid: delegation tag is invalid")
+		}
+	}
 
 	for _, reject := range rl.RejectEvent {
 		if reject, msg := reject(ctx, evt); reject {
@@ -25,59 +81,190 @@ func (rl *Relay) AddEvent(ctx context.Context, evt *nostr.Event) error {
 		}
 	}
 
+	for _, reject := range rl.RejectDuplicateContent {
+		if reject, msg := reject(ctx, evt); reject {
+			if msg == "" {
+				return errors.New("blocked: duplicate content")
+			} else {
+				return errors.New(nostr.NormalizeOKMessage(msg, "blocked"))
+			}
+		}
+	}
+
+	if len(rl.SpamScorers) > 0 {
+		var score float64
+		for _, scorer := range rl.SpamScorers {
+			score += scorer(ctx, evt)
+		}
+		if score > rl.SpamThreshold {
+			return RejectBlocked(fmt.Sprintf("flagged as spam (score %g)", score))
+		}
+	}
+
+	if rl.ModerationWebhook != nil {
+		if err := rl.ModerationWebhook.check(ctx, evt); err != nil {
+			return err
+		}
+	}
+
 	if 20000 <= evt.Kind && evt.Kind < 30000 {
 		// do not store ephemeral events
 		for _, oee := range rl.OnEphemeralEvent {
 			oee(ctx, evt)
 		}
 	} else {
-		if evt.Kind == 0 || evt.Kind == 3 || (10000 <= evt.Kind && evt.Kind < 20000) {
-			// replaceable event, delete before storing
-			for _, query := range rl.QueryEvents {
-				ch, err := query(ctx, nostr.Filter{Authors: []string{evt.PubKey}, Kinds: []int{evt.Kind}})
-				if err != nil {
-					continue
+		// everything below touches the storage, it goes through the breaker as a single call such that
+		// the previous version of a replaceable event is only deleted if the new one can be stored
+		var storageErr error
+		if rl.CircuitBreaker != nil {
+			if !rl.CircuitBreaker.allow() {
+				return errBreakerOpen
+			}
+			defer func() { rl.CircuitBreaker.done(storageErr) }()
+		}
+
+		if isReplaceable(evt.Kind) {
+			// versions of the same replaceable event are handled one at a time, otherwise two that arrive
+			// together could both be stored, or both delete each other
+			unlock := rl.replaceableLocks.lock(replaceableEventKey(evt))
+			defer unlock()
+
+			// delete the previous version before storing, unless it's newer than this one
+			var dTag string
+			if 30000 <= evt.Kind && evt.Kind < 40000 {
+				dTag = evt.Tags.GetD()
+			}
+			previous, err := rl.getReplaceable(ctx, evt.Kind, evt.PubKey, dTag)
+			if err != nil {
+				storageErr = err
+			}
+			if previous != nil {
+				if !rl.replaces(previous, evt) {
+					return &Rejection{PrefixDuplicate, "have a newer version of this event"}
 				}
-				if previous := <-ch; previous != nil && isOlder(previous, evt) {
-					for _, del := range rl.DeleteEvent {
-						del(ctx, previous)
-					}
+				if err := rl.deleteEvent(ctx, previous); err != nil {
+					storageErr = err
 				}
 			}
-		} else if 30000 <= evt.Kind && evt.Kind < 40000 {
-			// parameterized replaceable event, delete before storing
-			d := evt.Tags.GetFirst([]string{"d", ""})
-			if d != nil {
-				for _, query := range rl.QueryEvents {
-					ch, err := query(ctx, nostr.Filter{Authors: []string{evt.PubKey}, Kinds: []int{evt.Kind}, Tags: nostr.TagMap{"d": []string{d.Value()}}})
-					if err != nil {
-						continue
-					}
-					if previous := <-ch; previous != nil && isOlder(previous, evt) {
-						for _, del := range rl.DeleteEvent {
-							del(ctx, previous)
-						}
-					}
-				}
+		}
+
+		// the stored version may be different from what the client sent, but we only touch a copy
+		// so what is broadcasted to listeners is still the event as it was signed. anything that is part
+		// of the signed payload can't be changed though, as the stored event wouldn't verify anymore, so
+		// if that happens the changes are dropped and the event is stored as it was signed
+		stored := evt
+		if len(rl.OverwriteStoredEvent) > 0 {
+			stored = cloneEvent(evt)
+			for _, ovw := range rl.OverwriteStoredEvent {
+				ovw(ctx, stored)
+			}
+			if stored.ID != evt.ID || stored.Sig != evt.Sig || !bytes.Equal(stored.Serialize(), evt.Serialize()) {
+				rl.Log.Printf("OverwriteStoredEvent changed the signed payload of %s, storing it unchanged\n", evt.ID)
+				stored = evt
 			}
 		}
 
 		// store
 		for _, store := range rl.StoreEvent {
-			if saveErr := store(ctx, evt); saveErr != nil {
-				switch saveErr {
-				case eventstore.ErrDupEvent:
+			start := time.Now()
+			saveErr := store(ctx, stored)
+			if latency, ok := ctx.Value(storeLatencyKey).(*time.Duration); ok && saveErr == nil {
+				*latency += time.Since(start)
+			}
+			var rejection *Rejection
+			if saveErr != nil && saveErr != eventstore.ErrDupEvent && !errors.As(saveErr, &rejection) {
+				// duplicates and rejections mean the storage is working
+				storageErr = saveErr
+			}
+			if saveErr != nil {
+				switch {
+				case saveErr == eventstore.ErrDupEvent:
 					return nil
+				case errors.As(saveErr, &rejection):
+					return rejection
 				default:
 					return fmt.Errorf(nostr.NormalizeOKMessage(saveErr.Error(), "error"))
 				}
 			}
 		}
 
+		if rl.CacheReplaceables && isReplaceable(evt.Kind) && len(rl.StoreEvent) > 0 {
+			rl.cacheReplaceable(replaceableEventKey(stored), stored, rl.replaceables.currentGeneration())
+		}
+
+		rl.pruneByCount(ctx, evt)
+
+		if rl.EnableNIP40 {
+			rl.scheduleExpiration(evt)
+		}
+
 		for _, ons := range rl.OnEventSaved {
-			ons(ctx, evt)
+			ons(ctx, stored)
+		}
+
+		if evt.Kind == 1984 {
+			// nip56 report
+			for _, onr := range rl.OnReport {
+				onr(ctx, evt)
+			}
 		}
 	}
 
 	return nil
 }
+
+func isReplaceable(kind int) bool {
+	return kind == 0 || kind == 3 || (10000 <= kind && kind < 20000) || (30000 <= kind && kind < 40000)
+}
+
+func (rl *Relay) tooFarInTheFuture(evt *nostr.Event) bool {
+	return evt.CreatedAt.Time().After(time.Now().Add(rl.MaxReplaceableFutureDrift))
+}
+
+// replaces tells if next should take the place of the stored previous version of a replaceable event
+func (rl *Relay) replaces(previous, next *nostr.Event) bool {
+	if rl.MaxReplaceableFutureDrift > 0 && rl.tooFarInTheFuture(previous) {
+		return true
+	}
+	return isOlder(previous, next)
+}
+
+// GetReplaceable returns the current version of a replaceable or parameterized replaceable event,
+// the newest among the results of all QueryEvents. dTag is ignored for kinds that are not parameterized.
+// It returns nil without an error when nothing is found.
+func (rl *Relay) GetReplaceable(ctx context.Context, kind int, pubkey string, dTag string) (*nostr.Event, error) {
+	var newest *nostr.Event
+	err := rl.withBreaker(func() (err error) {
+		newest, err = rl.getReplaceable(ctx, kind, pubkey, dTag)
+		return err
+	})
+	return newest, err
+}
+
+// getReplaceable is GetReplaceable without the breaker, for when the caller already went through it
+func (rl *Relay) getReplaceable(ctx context.Context, kind int, pubkey string, dTag string) (*nostr.Event, error) {
+	filter := nostr.Filter{Authors: []string{pubkey}, Kinds: []int{kind}, Limit: 1}
+	if 30000 <= kind && kind < 40000 {
+		filter.Tags = nostr.TagMap{"d": []string{dTag}}
+	}
+
+	var newest *nostr.Event
+	var lastErr error
+	for _, query := range rl.QueryEvents {
+		ch, err := query(ctx, filter)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for evt := range ch {
+			if newest == nil || isOlder(newest, evt) {
+				newest = evt
+			}
+		}
+	}
+
+	if newest == nil {
+		return nil, lastErr
+	}
+	return newest, nil
+}
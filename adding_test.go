@@ -0,0 +1,156 @@
+package khatru
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestOverwriteStoredEventCantChangeTheSignedPayload(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.OverwriteStoredEvent = append(rl.OverwriteStoredEvent, func(ctx context.Context, event *nostr.Event) {
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				tag[1] = strings.ToLower(tag[1])
+			}
+		}
+	})
+
+	pubkey := strings.ToUpper(nostr.GeneratePrivateKey())
+	evt := mkev(t, 1, "hello", nostr.Tags{{"p", pubkey}})
+	if err := rl.AddEvent(context.Background(), evt); err != nil {
+		t.Fatalf("failed to add: %s", err)
+	}
+
+	stored := store.matching(nostr.Filter{IDs: []string{evt.ID}})
+	if len(stored) != 1 {
+		t.Fatalf("expected the event to be stored, got %d", len(stored))
+	}
+	if stored[0].Tags[0][1] != pubkey {
+		t.Fatalf("the stored event was changed: %s", stored[0])
+	}
+	if ok, _ := stored[0].CheckSignature(); !ok {
+		t.Fatalf("the stored event doesn't verify")
+	}
+}
+
+func TestAddressableEventsNeedExactlyOneDTag(t *testing.T) {
+	rl, store := newTestRelay()
+
+	for _, tc := range []struct {
+		tags nostr.Tags
+		err  string
+	}{
+		{nil, "invalid: addressable event must have exactly one d tag"},
+		{nostr.Tags{{"t", "x"}}, "invalid: addressable event must have exactly one d tag"},
+		{nostr.Tags{{"d", "a"}, {"d", "b"}}, "invalid: addressable event must have exactly one d tag"},
+		{nostr.Tags{{"d", "a"}, {"d", "a"}}, "invalid: addressable event must have exactly one d tag"},
+		{nostr.Tags{{"d"}}, "invalid: addressable event has a malformed d tag"},
+		{nostr.Tags{{"d", ""}}, ""},
+		{nostr.Tags{{"d", "a"}, {"t", "x"}}, ""},
+	} {
+		err := rl.AddEvent(context.Background(), mkev(t, 30023, "", tc.tags))
+		if tc.err == "" && err != nil {
+			t.Fatalf("%v: unexpected error %s", tc.tags, err)
+		} else if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Fatalf("%v: expected %q, got %v", tc.tags, tc.err, err)
+		}
+	}
+
+	// other kinds don't need it
+	if err := rl.AddEvent(context.Background(), mkev(t, 1, "", nostr.Tags{{"d", "a"}, {"d", "b"}})); err != nil {
+		t.Fatalf("unexpected error for a kind 1: %s", err)
+	}
+	if n := store.count(); n != 3 {
+		t.Fatalf("expected 3 stored events, got %d", n)
+	}
+}
+
+func TestReplaceableEventsTooFarInTheFuture(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.MaxReplaceableFutureDrift = 10 * time.Minute
+	ctx := context.Background()
+	at := func(kind int, content string, offset time.Duration) *nostr.Event {
+		evt := &nostr.Event{Kind: kind, Content: content, CreatedAt: nostr.Timestamp(time.Now().Add(offset).Unix())}
+		evt.Sign(testSecretKey)
+		return evt
+	}
+	current := func() string {
+		stored := store.matching(nostr.Filter{Kinds: []int{0}})
+		if len(stored) != 1 {
+			t.Fatalf("expected one kind 0, got %d", len(stored))
+		}
+		return stored[0].Content
+	}
+
+	if err := rl.AddEvent(ctx, at(0, "pinned", time.Hour)); err == nil || err.Error() != "invalid: replaceable event too far in the future" {
+		t.Fatalf("expected the future kind 0 to be rejected, got %v", err)
+	}
+	if err := rl.AddEvent(ctx, at(0, "skewed", 5*time.Minute)); err != nil {
+		t.Fatalf("a small clock skew should be accepted: %s", err)
+	}
+	if current() != "skewed" {
+		t.Fatalf("unexpected kind 0 %q", current())
+	}
+	if err := rl.AddEvent(ctx, at(1, "note", time.Hour)); err != nil {
+		t.Fatalf("other kinds are not affected: %s", err)
+	}
+
+	// a version that got stored before (or through another path) doesn't block the next ones
+	store.DeleteEvent(ctx, store.matching(nostr.Filter{Kinds: []int{0}})[0])
+	store.StoreEvent(ctx, at(0, "pinned", 24*time.Hour))
+	if err := rl.AddEvent(ctx, at(0, "now", 0)); err != nil {
+		t.Fatalf("failed to replace the future version: %s", err)
+	}
+	if current() != "now" {
+		t.Fatalf("the future version wasn't replaced, got %q", current())
+	}
+}
+
+func TestConcurrentVersionsOfAReplaceableEvent(t *testing.T) {
+	rl, store := newTestRelay()
+	// make the window between looking up the previous version and storing the new one wider
+	rl.QueryEvents = append(rl.QueryEvents[:0], func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		results := store.matching(filter)
+		ch := make(chan *nostr.Event, len(results))
+		for _, evt := range results {
+			ch <- evt
+		}
+		go func() {
+			time.Sleep(time.Millisecond)
+			close(ch)
+		}()
+		return ch, nil
+	})
+
+	const n = 50
+	base := time.Now().Add(-time.Hour)
+	events := make([]*nostr.Event, n)
+	for i := range events {
+		events[i] = &nostr.Event{Kind: 30000, Tags: nostr.Tags{{"d", "x"}}, Content: strconv.Itoa(i), CreatedAt: nostr.Timestamp(base.Add(time.Duration(i) * time.Second).Unix())}
+		events[i].Sign(testSecretKey)
+	}
+
+	var wg sync.WaitGroup
+	for _, evt := range events {
+		wg.Add(1)
+		go func(evt *nostr.Event) {
+			defer wg.Done()
+			rl.AddEvent(context.Background(), evt)
+		}(evt)
+	}
+	wg.Wait()
+
+	stored := store.matching(nostr.Filter{Kinds: []int{30000}, Tags: nostr.TagMap{"d": []string{"x"}}})
+	if len(stored) != 1 {
+		t.Fatalf("expected exactly one version to survive, got %d", len(stored))
+	}
+	if stored[0].Content != strconv.Itoa(n-1) {
+		t.Fatalf("expected the newest version to survive, got %s", stored[0].Content)
+	}
+}
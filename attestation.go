@@ -0,0 +1,99 @@
+package khatru
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// AttestationFeature is the name of the feature clients must declare in the X-Nostr-Features header to get
+// delivery attestations when SignedDelivery is enabled. Each EVENT sent to them is followed by
+//
+//	["ATTESTATION", <subscription id>, {"event": <event id>, "served_at": <unix timestamp>, "relay": <pubkey>, "sig": <sig>}]
+//
+// where "relay" is the public key of Relay.SelfSecretKey and "sig" is the hex-encoded schnorr signature of the
+// sha256 of "<event id>:<served_at>", such that clients can prove the relay served that event at that time.
+const AttestationFeature = "attestation"
+
+// Attestation is a statement signed by a relay saying it served an event at some time.
+type Attestation struct {
+	EventID  string          `json:"event"`
+	ServedAt nostr.Timestamp `json:"served_at"`
+	PubKey   string          `json:"relay"`
+	Sig      string          `json:"sig"`
+}
+
+func (a Attestation) hash() [32]byte {
+	return sha256.Sum256([]byte(a.EventID + ":" + strconv.FormatInt(int64(a.ServedAt), 10)))
+}
+
+// Verify tells if the signature is valid for the event id, timestamp and relay public key.
+func (a Attestation) Verify() bool {
+	pk, err := hex.DecodeString(a.PubKey)
+	if err != nil {
+		return false
+	}
+	pubkey, err := schnorr.ParsePubKey(pk)
+	if err != nil {
+		return false
+	}
+	s, err := hex.DecodeString(a.Sig)
+	if err != nil {
+		return false
+	}
+	sig, err := schnorr.ParseSignature(s)
+	if err != nil {
+		return false
+	}
+	h := a.hash()
+	return sig.Verify(h[:], pubkey)
+}
+
+type attestationEnvelope struct {
+	SubscriptionID string
+	Attestation
+}
+
+func (v attestationEnvelope) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{"ATTESTATION", v.SubscriptionID, v.Attestation})
+}
+
+// attester signs attestations with the relay key, it's created once from SelfSecretKey
+type attester struct {
+	sk     *btcec.PrivateKey
+	pubkey string
+}
+
+func (rl *Relay) getAttester() *attester {
+	rl.attesterOnce.Do(func() {
+		s, err := hex.DecodeString(rl.SelfSecretKey)
+		if err != nil {
+			rl.Log.Printf("invalid SelfSecretKey, delivery attestations are disabled: %v\n", err)
+			return
+		}
+		pubkey, err := nostr.GetPublicKey(rl.SelfSecretKey)
+		if err != nil {
+			rl.Log.Printf("invalid SelfSecretKey, delivery attestations are disabled: %v\n", err)
+			return
+		}
+		sk, _ := btcec.PrivKeyFromBytes(s)
+		rl.attester = &attester{sk: sk, pubkey: pubkey}
+	})
+	return rl.attester
+}
+
+func (a *attester) attest(subID string, eventID string) (attestationEnvelope, error) {
+	att := Attestation{EventID: eventID, ServedAt: nostr.Now(), PubKey: a.pubkey}
+	h := att.hash()
+	sig, err := schnorr.Sign(a.sk, h[:])
+	if err != nil {
+		return attestationEnvelope{}, err
+	}
+	att.Sig = hex.EncodeToString(sig.Serialize())
+	return attestationEnvelope{SubscriptionID: subID, Attestation: att}, nil
+}
@@ -0,0 +1,139 @@
+package khatru
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errBreakerOpen = errors.New("error: relay temporarily unavailable")
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // the storage is called normally
+	BreakerHalfOpen                     // one call is allowed through to check if the storage is back
+	BreakerOpen                         // calls fail immediately without reaching the storage
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops calling the storage functions (StoreEvent, DeleteEvent, QueryEvents and CountEvents) after
+// Threshold consecutive errors, such that requests fail immediately instead of piling up. After Cooldown
+// one call is let through and the breaker closes again if it succeeds, otherwise it waits another Cooldown.
+type CircuitBreaker struct {
+	Threshold int           // defaults to 5
+	Cooldown  time.Duration // defaults to 30 seconds
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// State returns the current state of the breaker.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown() {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+func (b *CircuitBreaker) cooldown() time.Duration {
+	if b.Cooldown <= 0 {
+		return 30 * time.Second
+	}
+	return b.Cooldown
+}
+
+// allow tells if a call to the storage can be made now, each allowed call must be followed by a call to done.
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown() {
+		b.state = BreakerHalfOpen
+	}
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// skip is called instead of done when an allowed call ended up not being made
+func (b *CircuitBreaker) skip() {
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// done records the result of a call to the storage
+func (b *CircuitBreaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	threshold := b.Threshold
+	if threshold <= 0 {
+		threshold = 5
+	}
+
+	b.probing = false
+	if err == nil {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// withBreaker makes a call to the storage through the CircuitBreaker, if there is one, and returns
+// errBreakerOpen without making it if the breaker doesn't allow it
+func (rl *Relay) withBreaker(call func() error) error {
+	if rl.CircuitBreaker == nil {
+		return call()
+	}
+	if !rl.CircuitBreaker.allow() {
+		return errBreakerOpen
+	}
+	err := call()
+	rl.CircuitBreaker.done(err)
+	return err
+}
+
+// queryDone records the result of a query whose events were all read from its channel, only a timeout counts
+// as a failure of the storage, a query canceled by the client or with CancelQuery tells us nothing about it
+func (b *CircuitBreaker) queryDone(sctx context.Context, qctx context.Context) {
+	switch {
+	case errors.Is(qctx.Err(), context.DeadlineExceeded) && sctx.Err() == nil:
+		b.done(qctx.Err())
+	case qctx.Err() != nil:
+		b.skip()
+	default:
+		b.done(nil)
+	}
+}
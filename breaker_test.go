@@ -0,0 +1,103 @@
+package khatru
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBreakerOpenKeepsThePreviousReplaceable(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.CircuitBreaker = &CircuitBreaker{Threshold: 1, Cooldown: time.Hour}
+	var failing atomic.Bool
+	rl.StoreEvent = append([]func(ctx context.Context, event *nostr.Event) error{
+		func(ctx context.Context, event *nostr.Event) error {
+			if failing.Load() {
+				return errors.New("storage is down")
+			}
+			return nil
+		},
+	}, rl.StoreEvent...)
+
+	profile := mkev(t, 0, "first", nil)
+	if err := rl.AddEvent(context.Background(), profile); err != nil {
+		t.Fatalf("failed to add: %s", err)
+	}
+
+	failing.Store(true)
+	if err := rl.AddEvent(context.Background(), mkev(t, 1, "note", nil)); err == nil {
+		t.Fatalf("expected the store to fail")
+	}
+	if state := rl.CircuitBreaker.State(); state != BreakerOpen {
+		t.Fatalf("expected the breaker to be open, it's %s", state)
+	}
+
+	updated := mkev(t, 0, "second", nil)
+	updated.CreatedAt = profile.CreatedAt + 1
+	updated.Sign(testSecretKey)
+	if err := rl.AddEvent(context.Background(), updated); err != errBreakerOpen {
+		t.Fatalf("expected the update to be rejected by the breaker, got %v", err)
+	}
+	if stored := store.matching(nostr.Filter{Kinds: []int{0}}); len(stored) != 1 || stored[0].ID != profile.ID {
+		t.Fatalf("the previous version should still be stored, got %v", stored)
+	}
+}
+
+func TestBreakerTripsOnQueriesThatTimeOutWhileStreaming(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.CircuitBreaker = &CircuitBreaker{Threshold: 2, Cooldown: time.Hour}
+	rl.QueryTimeout = 50 * time.Millisecond
+	var hanging atomic.Bool
+	rl.QueryEvents = []func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error){
+		func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+			if !hanging.Load() {
+				return store.QueryEvents(ctx, filter)
+			}
+			// returns right away and then never sends anything
+			ch := make(chan *nostr.Event)
+			go func() {
+				<-ctx.Done()
+				close(ch)
+			}()
+			return ch, nil
+		},
+	}
+	url := serve(t, rl)
+	client := dial(t, url)
+
+	// a subscription closed by the client doesn't count
+	hanging.Store(true)
+	rl.QueryTimeout = time.Hour
+	client.send("REQ", "a", nostr.Filter{Kinds: []int{1}})
+	waitFor(t, "query", func() bool { return len(rl.InFlightQueries()) == 1 })
+	client.send("CLOSE", "a")
+	waitFor(t, "CLOSE", func() bool { return len(rl.InFlightQueries()) == 0 })
+	client.send("REQ", "b", nostr.Filter{Kinds: []int{1}})
+	waitFor(t, "query", func() bool { return len(rl.InFlightQueries()) == 1 })
+	client.send("CLOSE", "b")
+	waitFor(t, "CLOSE", func() bool { return len(rl.InFlightQueries()) == 0 })
+	if state := rl.CircuitBreaker.State(); state != BreakerClosed {
+		t.Fatalf("expected the breaker to be closed, it's %s", state)
+	}
+
+	// but queries that time out do
+	rl.QueryTimeout = 50 * time.Millisecond
+	client = dial(t, url)
+	for _, id := range []string{"c", "d"} {
+		client.send("REQ", id, nostr.Filter{Kinds: []int{1}})
+		client.until("EOSE")
+	}
+	waitFor(t, "queries", func() bool { return len(rl.InFlightQueries()) == 0 })
+	if state := rl.CircuitBreaker.State(); state != BreakerOpen {
+		t.Fatalf("expected the breaker to be open, it's %s", state)
+	}
+
+	client.send("REQ", "e", nostr.Filter{Kinds: []int{1}})
+	if msg, _ := client.until("CLOSED"); string(msg[2]) != `"error: relay temporarily unavailable"` {
+		t.Fatalf("unexpected CLOSED %s", msg)
+	}
+}
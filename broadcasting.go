@@ -1,11 +1,84 @@
 package khatru
 
 import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fasthttp/websocket"
 	"github.com/nbd-wtf/go-nostr"
 )
 
 // BroadcastEvent emits an event to all listeners whose filters' match, skipping all filters and actions
-// it also doesn't attempt to store the event or trigger any reactions or callbacks
-func (rl *Relay) BroadcastEvent(evt *nostr.Event) {
-	notifyListeners(evt)
+// it also doesn't attempt to store the event or trigger any reactions or callbacks.
+// It returns the number of subscriptions the event was delivered to.
+func (rl *Relay) BroadcastEvent(evt *nostr.Event) int {
+	return rl.notifyListeners(evt)
+}
+
+// notifyListeners wraps the global notifyListeners keeping track of the fanout statistics
+func (rl *Relay) notifyListeners(evt *nostr.Event) int {
+	if rl.CompressionDictionary != nil {
+		rl.CompressionDictionary.sample(evt)
+	}
+	var reject func(ctx context.Context, event *nostr.Event) bool
+	if len(rl.RejectResponseEvent) > 0 {
+		reject = rl.rejectResponseEvent
+	}
+	delivered := notifyListeners(evt, reject, rl.DedupDeliveryPerConnection)
+	rl.broadcasted.Add(1)
+	rl.delivered.Add(int64(delivered))
+	return delivered
+}
+
+// rejectResponseEvent tells if the event shouldn't be sent to the subscription of the given context,
+// it's checked for stored events after OverwriteResponseEvent and for live events of each matching subscription.
+func (rl *Relay) rejectResponseEvent(ctx context.Context, event *nostr.Event) bool {
+	for _, reject := range rl.RejectResponseEvent {
+		if reject(ctx, event) {
+			return true
+		}
+	}
+	return false
+}
+
+// AverageFanout returns the average number of subscriptions each broadcasted event was delivered to.
+func (rl *Relay) AverageFanout() float64 {
+	broadcasted := rl.broadcasted.Load()
+	if broadcasted == 0 {
+		return 0
+	}
+	return float64(rl.delivered.Load()) / float64(broadcasted)
+}
+
+// BroadcastNotice sends a NOTICE with the given message to all connected clients,
+// each write happens on its own goroutine so a slow client can't hold the others back.
+func (rl *Relay) BroadcastNotice(message string) {
+	rl.clients.Range(func(_ *websocket.Conn, ws *WebSocket) bool {
+		go ws.WriteJSON(nostr.NoticeEnvelope(message))
+		return true
+	})
+}
+
+// DrainConnection closes all subscriptions of the given connection with a "restart:" reason and then
+// closes the connection itself with a "service restart" close frame, so the client reconnects elsewhere.
+// It's safe to call it concurrently and multiple times, only the first call does anything.
+func (rl *Relay) DrainConnection(ws *WebSocket) {
+	ws.drainOnce.Do(func() {
+		if subs, ok := listeners.LoadAndDelete(ws); ok {
+			subs.Range(func(id string, listener *Listener) bool {
+				listener.cancel(fmt.Errorf("connection drained"))
+				ws.SendClosed(id, "restart: relay is restarting, please reconnect")
+				return true
+			})
+		}
+
+		closeMessage := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "restarting")
+		if ws.queue != nil && ws.enqueue(queuedMessage{websocket.CloseMessage, closeMessage}) == nil {
+			// the CLOSED messages are still in the queue, the close frame goes after them
+			return
+		}
+		ws.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(rl.WriteWait))
+		ws.conn.Close()
+	})
 }
@@ -0,0 +1,178 @@
+package khatru
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CompressionDictionaryFeature is the name of the feature clients must declare in the X-Nostr-Features header
+// to get messages compressed with the relay's zstd dictionary.
+const CompressionDictionaryFeature = "zstd-dict"
+
+// CompressionDictionary keeps a zstd dictionary trained on the most recent events that went through the relay.
+// Connections that negotiated CompressionDictionaryFeature get all messages as binary websocket frames with
+// zstd-compressed JSON. Each frame carries the id of the dictionary that was used (or none, before the first
+// training), clients can fetch it at /compression/dictionary?id=<id>. The previous dictionary is kept along
+// with the current one, so frames compressed right before a retraining can still be decoded.
+type CompressionDictionary struct {
+	// how many recent events are kept as training samples, defaults to 1000.
+	// the first dictionary is trained as soon as this many events were seen
+	Samples int
+
+	// how often the dictionary is rebuilt from the samples, defaults to 10 minutes
+	RetrainInterval time.Duration
+
+	mutex     sync.Mutex
+	samples   [][]byte
+	next      int
+	lastTrain time.Time
+	training  atomic.Bool
+
+	current  atomic.Pointer[trainedDictionary]
+	previous atomic.Pointer[trainedDictionary]
+	plain    *zstd.Encoder
+	once     sync.Once
+}
+
+type trainedDictionary struct {
+	id      uint32
+	raw     []byte
+	encoder *zstd.Encoder
+}
+
+func (cd *CompressionDictionary) init() {
+	cd.once.Do(func() {
+		if cd.Samples <= 0 {
+			cd.Samples = 1000
+		}
+		if cd.RetrainInterval <= 0 {
+			cd.RetrainInterval = 10 * time.Minute
+		}
+		cd.samples = make([][]byte, 0, cd.Samples)
+		cd.lastTrain = time.Now()
+		cd.plain, _ = zstd.NewWriter(nil)
+	})
+}
+
+// compress returns the zstd-compressed message using the current dictionary, if there is one.
+func (cd *CompressionDictionary) compress(message []byte) []byte {
+	cd.init()
+	if dict := cd.current.Load(); dict != nil {
+		return dict.encoder.EncodeAll(message, nil)
+	}
+	return cd.plain.EncodeAll(message, nil)
+}
+
+// sample stores the event as a training sample and triggers a retraining in the background when it's due.
+func (cd *CompressionDictionary) sample(event *nostr.Event) {
+	cd.init()
+	j, err := json.Marshal(nostr.EventEnvelope{Event: *event})
+	if err != nil {
+		return
+	}
+
+	cd.mutex.Lock()
+	if len(cd.samples) < cd.Samples {
+		cd.samples = append(cd.samples, j)
+	} else {
+		cd.samples[cd.next] = j
+		cd.next = (cd.next + 1) % cd.Samples
+	}
+	// only train once we have a full set of samples, too few of them make for a useless dictionary
+	due := len(cd.samples) == cd.Samples && (cd.current.Load() == nil || time.Since(cd.lastTrain) > cd.RetrainInterval)
+	cd.mutex.Unlock()
+
+	if due && cd.training.CompareAndSwap(false, true) {
+		go func() {
+			defer cd.training.Store(false)
+			cd.train()
+		}()
+	}
+}
+
+func (cd *CompressionDictionary) train() {
+	defer func() {
+		// BuildDict can panic on degenerate inputs, in which case we just keep the previous dictionary
+		recover()
+	}()
+
+	cd.mutex.Lock()
+	contents := make([][]byte, len(cd.samples))
+	copy(contents, cd.samples)
+	cd.lastTrain = time.Now()
+	cd.mutex.Unlock()
+
+	// the history is made of the most recent samples, limited to what a dictionary can reasonably hold
+	history := make([]byte, 0, 64*1024)
+	for i := len(contents) - 1; i >= 0 && len(history)+len(contents[i]) <= cap(history); i-- {
+		history = append(history, contents[i]...)
+	}
+
+	var id uint32 = 1
+	if previous := cd.current.Load(); previous != nil {
+		id = previous.id + 1
+	}
+
+	raw, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: contents,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+	if err != nil {
+		// keep using the previous dictionary
+		return
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(raw))
+	if err != nil {
+		return
+	}
+
+	// the previous one is kept first, so it's always found by its id while the current one is replaced
+	cd.previous.Store(cd.current.Load())
+	cd.current.Store(&trainedDictionary{id: id, raw: raw, encoder: encoder})
+}
+
+// dictionary returns the current or the previous dictionary with the given id, or nil.
+func (cd *CompressionDictionary) dictionary(id uint32) *trainedDictionary {
+	for _, dict := range []*trainedDictionary{cd.current.Load(), cd.previous.Load()} {
+		if dict != nil && dict.id == id {
+			return dict
+		}
+	}
+	return nil
+}
+
+// HandleCompressionDictionary serves the dictionary with the id given in the "id" query parameter, or the
+// current one if there is none, with its id in the X-Dictionary-Id header. It's mounted at
+// /compression/dictionary if CompressionDictionary is set.
+func (rl *Relay) HandleCompressionDictionary(w http.ResponseWriter, r *http.Request) {
+	var dict *trainedDictionary
+	if param := r.URL.Query().Get("id"); param != "" {
+		id, err := strconv.ParseUint(param, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid dictionary id", http.StatusBadRequest)
+			return
+		}
+		dict = rl.CompressionDictionary.dictionary(uint32(id))
+		if dict == nil {
+			http.Error(w, "unknown dictionary", http.StatusNotFound)
+			return
+		}
+	} else if dict = rl.CompressionDictionary.current.Load(); dict == nil {
+		http.Error(w, "no dictionary trained yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Dictionary-Id", strconv.FormatUint(uint64(dict.id), 10))
+	w.Write(dict.raw)
+}
@@ -0,0 +1,102 @@
+package khatru
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// homogeneousEvents are like the notes of a busy relay: same kind, same kinds of tags, similar content
+func homogeneousEvents(tb testing.TB, n int) [][]byte {
+	messages := make([][]byte, n)
+	subID := "feed"
+	for i := range messages {
+		evt := mkev(tb, 1, fmt.Sprintf("gm nostr! this is note number %d, have a great day #nostr #gm", i), nostr.Tags{
+			{"t", "nostr"},
+			{"t", "gm"},
+			{"p", fmt.Sprintf("%064x", i%20)},
+			{"client", "khatru-bench"},
+		})
+		messages[i], _ = json.Marshal(nostr.EventEnvelope{SubscriptionID: &subID, Event: *evt})
+	}
+	return messages
+}
+
+// BenchmarkCompressionDictionary compresses a homogeneous stream of EVENT messages without compression, with
+// plain zstd and with a dictionary trained on the stream, reporting the bytes that go out for each message
+func BenchmarkCompressionDictionary(b *testing.B) {
+	messages := homogeneousEvents(b, 2000)
+
+	trained := &CompressionDictionary{Samples: 1000}
+	trained.init()
+	for _, message := range messages[:1000] {
+		var env nostr.EventEnvelope
+		env.UnmarshalJSON(message)
+		trained.sample(&env.Event)
+	}
+	// the first training starts as soon as the samples are full
+	waitFor(b, "the dictionary", func() bool { return trained.current.Load() != nil })
+
+	plain := &CompressionDictionary{}
+	plain.init()
+
+	// only the messages that weren't used in the training are compressed
+	stream := messages[1000:]
+	for _, bc := range []struct {
+		name     string
+		compress func([]byte) []byte
+	}{
+		{"none", func(message []byte) []byte { return message }},
+		{"zstd", plain.compress},
+		{"zstd+dictionary", trained.compress},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var raw, sent int
+			for i := 0; i < b.N; i++ {
+				message := stream[i%len(stream)]
+				raw += len(message)
+				sent += len(bc.compress(message))
+			}
+			b.ReportMetric(float64(sent)/float64(b.N), "bytes/msg")
+			b.ReportMetric(1-float64(sent)/float64(raw), "saved")
+		})
+	}
+}
+
+func TestCompressionDictionaryKeepsThePreviousOne(t *testing.T) {
+	cd := &CompressionDictionary{Samples: 500, RetrainInterval: time.Hour}
+	for _, message := range homogeneousEvents(t, 500) {
+		var env nostr.EventEnvelope
+		env.UnmarshalJSON(message)
+		cd.sample(&env.Event)
+	}
+	// trained right away the first time, even though the interval hasn't passed
+	waitFor(t, "the first dictionary", func() bool { return cd.current.Load() != nil })
+	waitFor(t, "the training to finish", func() bool { return !cd.training.Load() })
+	cd.train()
+
+	rl := NewRelay()
+	rl.CompressionDictionary = cd
+	for _, tc := range []struct {
+		query  string
+		status int
+		id     string
+	}{
+		{"", http.StatusOK, "2"},
+		{"?id=2", http.StatusOK, "2"},
+		{"?id=1", http.StatusOK, "1"},
+		{"?id=3", http.StatusNotFound, ""},
+		{"?id=x", http.StatusBadRequest, ""},
+	} {
+		w := httptest.NewRecorder()
+		rl.HandleCompressionDictionary(w, httptest.NewRequest("GET", "/compression/dictionary"+tc.query, nil))
+		if w.Code != tc.status || w.Header().Get("X-Dictionary-Id") != tc.id {
+			t.Fatalf("%q: expected %d with id %q, got %d with id %q", tc.query, tc.status, tc.id, w.Code, w.Header().Get("X-Dictionary-Id"))
+		}
+	}
+}
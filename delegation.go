@@ -0,0 +1,99 @@
+package khatru
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// GetDelegator returns the pubkey of the delegator if the event carries a NIP-26 "delegation" tag.
+// It returns an empty string if there is no such tag and an error if the tag is invalid, either
+// because the signature doesn't match or because the event doesn't satisfy the delegation conditions.
+func GetDelegator(evt *nostr.Event) (string, error) {
+	tag := evt.Tags.GetFirst([]string{"delegation", ""})
+	if tag == nil {
+		return "", nil
+	}
+	if len(*tag) < 4 {
+		return "", errors.New("delegation tag is incomplete")
+	}
+	delegator, conditions, token := (*tag)[1], (*tag)[2], (*tag)[3]
+
+	// check the delegation token
+	pkb, err := hex.DecodeString(delegator)
+	if err != nil || len(pkb) != 32 {
+		return "", errors.New("delegator pubkey is invalid")
+	}
+	pk, err := schnorr.ParsePubKey(pkb)
+	if err != nil {
+		return "", errors.New("delegator pubkey is invalid")
+	}
+	sigb, err := hex.DecodeString(token)
+	if err != nil {
+		return "", errors.New("delegation token is malformed")
+	}
+	sig, err := schnorr.ParseSignature(sigb)
+	if err != nil {
+		return "", errors.New("delegation token is malformed")
+	}
+	hash := sha256.Sum256([]byte("nostr:delegation:" + evt.PubKey + ":" + conditions))
+	if !sig.Verify(hash[:], pk) {
+		return "", errors.New("delegation token signature is invalid")
+	}
+
+	// check the conditions (if there are many kind conditions any of them can match)
+	hasKindConditions := false
+	kindAllowed := false
+	for _, cond := range strings.Split(conditions, "&") {
+		switch {
+		case cond == "":
+			continue
+		case strings.HasPrefix(cond, "kind="):
+			kind, err := strconv.Atoi(cond[5:])
+			if err != nil {
+				return "", errors.New("delegation condition is malformed")
+			}
+			hasKindConditions = true
+			if evt.Kind == kind {
+				kindAllowed = true
+			}
+		case strings.HasPrefix(cond, "created_at<"):
+			ts, err := strconv.ParseInt(cond[11:], 10, 64)
+			if err != nil {
+				return "", errors.New("delegation condition is malformed")
+			}
+			if int64(evt.CreatedAt) >= ts {
+				return "", errors.New("event is too new for this delegation")
+			}
+		case strings.HasPrefix(cond, "created_at>"):
+			ts, err := strconv.ParseInt(cond[11:], 10, 64)
+			if err != nil {
+				return "", errors.New("delegation condition is malformed")
+			}
+			if int64(evt.CreatedAt) <= ts {
+				return "", errors.New("event is too old for this delegation")
+			}
+		default:
+			return "", errors.New("delegation condition is unknown")
+		}
+	}
+	if hasKindConditions && !kindAllowed {
+		return "", errors.New("event kind not allowed by delegation")
+	}
+
+	return delegator, nil
+}
+
+// GetEffectiveAuthor returns the delegator if the event is validly delegated according to NIP-26,
+// otherwise the event pubkey. It is meant to be used by policies that check authors against allowlists.
+func GetEffectiveAuthor(evt *nostr.Event) string {
+	if delegator, err := GetDelegator(evt); err == nil && delegator != "" {
+		return delegator
+	}
+	return evt.PubKey
+}
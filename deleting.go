@@ -8,6 +8,10 @@ import (
 )
 
 func (rl *Relay) handleDeleteRequest(ctx context.Context, evt *nostr.Event) error {
+	if rl.ReadOnly && isFromClient(ctx) {
+		return fmt.Errorf("blocked: this relay is read-only")
+	}
+
 	// event deletion -- nip09
 	for _, tag := range evt.Tags {
 		if len(tag) >= 2 && tag[0] == "e" {
@@ -33,8 +37,11 @@ func (rl *Relay) handleDeleteRequest(ctx context.Context, evt *nostr.Event) erro
 				}
 				if acceptDeletion {
 					// delete it
-					for _, del := range rl.DeleteEvent {
-						del(ctx, target)
+					if err := rl.withBreaker(func() error { return rl.deleteEvent(ctx, target) }); err == errBreakerOpen {
+						return err
+					}
+					if rl.ServeTombstones {
+						rl.addTombstone(target, evt)
 					}
 				} else {
 					// fail and stop here
@@ -49,3 +56,25 @@ func (rl *Relay) handleDeleteRequest(ctx context.Context, evt *nostr.Event) erro
 
 	return nil
 }
+
+// RemoveEvent deletes an event from storage, like a NIP-09 deletion would but without a tombstone. Code outside
+// the relay should use this instead of calling the DeleteEvent functions directly, as it also keeps the caches
+// of the relay in sync. It returns the first error from the DeleteEvent functions.
+func (rl *Relay) RemoveEvent(ctx context.Context, evt *nostr.Event) error {
+	return rl.withBreaker(func() error { return rl.deleteEvent(ctx, evt) })
+}
+
+// deleteEvent calls all DeleteEvent functions for an event and forgets it if it's cached, it returns the
+// first error from them
+func (rl *Relay) deleteEvent(ctx context.Context, evt *nostr.Event) error {
+	var firstErr error
+	for _, del := range rl.DeleteEvent {
+		if err := del(ctx, evt); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if rl.CacheReplaceables && isReplaceable(evt.Kind) {
+		rl.replaceables.forget(evt)
+	}
+	return firstErr
+}
@@ -0,0 +1,185 @@
+package khatru
+
+import (
+	"container/heap"
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// getExpiration returns the timestamp from the NIP-40 "expiration" tag, if the event has one
+func getExpiration(evt *nostr.Event) (nostr.Timestamp, bool) {
+	tag := evt.Tags.GetFirst([]string{"expiration", ""})
+	if tag == nil {
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(tag.Value(), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return nostr.Timestamp(ts), true
+}
+
+func isExpired(evt *nostr.Event) bool {
+	expiration, ok := getExpiration(evt)
+	return ok && expiration <= nostr.Now()
+}
+
+type expiringEvent struct {
+	id         string
+	expiration nostr.Timestamp
+}
+
+// expirationQueue is a min-heap of events ordered by their expiration
+type expirationQueue struct {
+	mutex     sync.Mutex
+	events    []expiringEvent
+	scheduled map[string]struct{}
+
+	// set when an event couldn't be scheduled because the queue was full
+	overflowed bool
+}
+
+// how many stored events are read at once when scanning the storage for expirations
+const expirationScanBatch = 500
+
+func (q *expirationQueue) Len() int           { return len(q.events) }
+func (q *expirationQueue) Less(i, j int) bool { return q.events[i].expiration < q.events[j].expiration }
+func (q *expirationQueue) Swap(i, j int)      { q.events[i], q.events[j] = q.events[j], q.events[i] }
+func (q *expirationQueue) Push(x any)         { q.events = append(q.events, x.(expiringEvent)) }
+func (q *expirationQueue) Pop() any {
+	last := q.events[len(q.events)-1]
+	q.events = q.events[0 : len(q.events)-1]
+	return last
+}
+
+// scheduleExpiration makes the sweeper delete the event once its expiration is reached
+func (rl *Relay) scheduleExpiration(evt *nostr.Event) {
+	expiration, ok := getExpiration(evt)
+	if !ok {
+		return
+	}
+
+	rl.expirations.mutex.Lock()
+	defer rl.expirations.mutex.Unlock()
+	if rl.expirations.scheduled == nil {
+		rl.expirations.scheduled = make(map[string]struct{})
+	}
+	if _, ok := rl.expirations.scheduled[evt.ID]; ok {
+		return
+	}
+	if rl.expirations.Len() >= rl.maxScheduledExpirations() {
+		// it will be found by the next scan of the storage
+		rl.expirations.overflowed = true
+		return
+	}
+	rl.expirations.scheduled[evt.ID] = struct{}{}
+	heap.Push(&rl.expirations, expiringEvent{id: evt.ID, expiration: expiration})
+}
+
+func (rl *Relay) maxScheduledExpirations() int {
+	if rl.NIP40MaxScheduled <= 0 {
+		return 100000
+	}
+	return rl.NIP40MaxScheduled
+}
+
+// scanExpirations goes through all stored events, from the newest to the oldest, and schedules the ones that have
+// an expiration tag. It stops early if the queue gets full.
+func (rl *Relay) scanExpirations(ctx context.Context) {
+	rl.expirations.mutex.Lock()
+	rl.expirations.overflowed = false
+	rl.expirations.mutex.Unlock()
+
+	for _, query := range rl.QueryEvents {
+		filter := nostr.Filter{Limit: expirationScanBatch}
+		for ctx.Err() == nil {
+			var oldest *nostr.Event
+			n := 0
+			err := rl.withBreaker(func() error {
+				ch, err := query(ctx, filter)
+				if err != nil {
+					return err
+				}
+				for evt := range ch {
+					n++
+					if oldest == nil || evt.CreatedAt < oldest.CreatedAt {
+						oldest = evt
+					}
+					rl.scheduleExpiration(evt)
+				}
+				return nil
+			})
+			if err != nil || n < expirationScanBatch {
+				break
+			}
+
+			rl.expirations.mutex.Lock()
+			full := rl.expirations.overflowed
+			rl.expirations.mutex.Unlock()
+			if full {
+				return
+			}
+
+			// until is inclusive, the events at the boundary are read again and skipped as they're scheduled
+			// already, unless the whole batch had the same timestamp and we'd never get past it
+			until := oldest.CreatedAt
+			if filter.Until != nil && *filter.Until == until {
+				until--
+			}
+			filter.Until = &until
+		}
+	}
+}
+
+// sweepExpiredEvents scans the storage for events with an expiration and then deletes scheduled events as they
+// expire, every NIP40SweepInterval, until ctx is canceled.
+func (rl *Relay) sweepExpiredEvents(ctx context.Context) {
+	interval := rl.NIP40SweepInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	rl.scanExpirations(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := nostr.Now()
+		ids := make([]string, 0)
+		rl.expirations.mutex.Lock()
+		for rl.expirations.Len() > 0 && rl.expirations.events[0].expiration <= now {
+			id := heap.Pop(&rl.expirations).(expiringEvent).id
+			delete(rl.expirations.scheduled, id)
+			ids = append(ids, id)
+		}
+		rescan := rl.expirations.overflowed && len(ids) > 0
+		rl.expirations.mutex.Unlock()
+
+		for _, query := range rl.QueryEvents {
+			if len(ids) == 0 {
+				break
+			}
+			ch, err := query(ctx, nostr.Filter{IDs: ids})
+			if err != nil {
+				continue
+			}
+			for evt := range ch {
+				rl.RemoveEvent(ctx, evt)
+			}
+		}
+
+		if rescan {
+			// some events were left out of the queue when it was full, now they fit
+			rl.scanExpirations(ctx)
+		}
+	}
+}
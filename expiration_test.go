@@ -0,0 +1,66 @@
+package khatru
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func expiringAt(t *testing.T, content string, ts nostr.Timestamp) *nostr.Event {
+	t.Helper()
+	return mkev(t, 1, content, nostr.Tags{{"expiration", strconv.FormatInt(int64(ts), 10)}})
+}
+
+func TestExpiredEventsStoredBeforeStartAreSwept(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.EnableNIP40 = true
+	rl.NIP40SweepInterval = 10 * time.Millisecond
+	rl.NIP40MaxScheduled = 3
+
+	// as if they had been stored by a previous run of the relay, more than fit in the queue at once
+	// and in more than one batch of the scan
+	for i := 0; i < expirationScanBatch+10; i++ {
+		evt := mkev(t, 1, "kept "+strconv.Itoa(i), nil)
+		evt.CreatedAt -= nostr.Timestamp(i % 7)
+		store.StoreEvent(context.Background(), evt)
+	}
+	for i := 0; i < 10; i++ {
+		store.StoreEvent(context.Background(), expiringAt(t, "expired "+strconv.Itoa(i), nostr.Now()-1))
+	}
+	later := expiringAt(t, "later", nostr.Now()+3600)
+	store.StoreEvent(context.Background(), later)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rl.sweepExpiredEvents(ctx)
+
+	waitFor(t, "the expired events to be deleted", func() bool { return store.count() == expirationScanBatch+11 })
+	if stored := store.matching(nostr.Filter{IDs: []string{later.ID}}); len(stored) != 1 {
+		t.Fatalf("expected the event that expires later to be kept")
+	}
+	rl.expirations.mutex.Lock()
+	defer rl.expirations.mutex.Unlock()
+	if n := rl.expirations.Len(); n > 3 {
+		t.Fatalf("the queue grew over its maximum to %d", n)
+	}
+}
+
+func TestExpirationQueueIsCapped(t *testing.T) {
+	rl, _ := newTestRelay()
+	rl.EnableNIP40 = true
+	rl.NIP40MaxScheduled = 5
+	for i := 0; i < 20; i++ {
+		if err := rl.AddEvent(context.Background(), expiringAt(t, strconv.Itoa(i), nostr.Now()+3600)); err != nil {
+			t.Fatalf("failed to add: %s", err)
+		}
+	}
+
+	rl.expirations.mutex.Lock()
+	defer rl.expirations.mutex.Unlock()
+	if n := rl.expirations.Len(); n != 5 || !rl.expirations.overflowed {
+		t.Fatalf("expected 5 scheduled expirations and the rest left for a scan, got %d", n)
+	}
+}
@@ -0,0 +1,47 @@
+package khatru
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+)
+
+// Features describes which of the relay capabilities and policies are currently configured.
+type Features struct {
+	AuthRequired  bool `json:"auth_required"`
+	SearchEnabled bool `json:"search_enabled"`
+	CountEnabled  bool `json:"count_enabled"`
+	RateLimited   bool `json:"rate_limited"`
+	ReadOnly      bool `json:"read_only"`
+	WriteOnly     bool `json:"write_only"`
+	Firehose      bool `json:"firehose"`
+
+	RejectEventHooks  int `json:"reject_event_hooks"`
+	RejectFilterHooks int `json:"reject_filter_hooks"`
+	StoreEventHooks   int `json:"store_event_hooks"`
+	QueryEventsHooks  int `json:"query_events_hooks"`
+}
+
+// Features returns a snapshot of the features derived from the current relay configuration.
+func (rl *Relay) Features() Features {
+	return Features{
+		AuthRequired:  rl.Info.Limitation != nil && rl.Info.Limitation.AuthRequired,
+		SearchEnabled: !rl.RejectSearchWhenUnsupported && slices.Contains(rl.Info.SupportedNIPs, 50),
+		CountEnabled:  len(rl.CountEvents) > 0 || len(rl.CountEventsHLL) > 0,
+		RateLimited:   rl.MaxAuthAttemptsPerConnection > 0 || rl.MaxAuthAttemptsPerIP > 0 || rl.EventIPLimiter != nil,
+		ReadOnly:      rl.ReadOnly,
+		WriteOnly:     rl.WriteOnly,
+		Firehose:      len(rl.FirehoseAdmins) > 0,
+
+		RejectEventHooks:  len(rl.RejectEvent),
+		RejectFilterHooks: len(rl.RejectFilter),
+		StoreEventHooks:   len(rl.StoreEvent),
+		QueryEventsHooks:  len(rl.QueryEvents),
+	}
+}
+
+// HandleFeatures serves the output of Features as JSON, it's mounted at /info/features if ServeFeatures is true.
+func (rl *Relay) HandleFeatures(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rl.Features())
+}
@@ -0,0 +1,76 @@
+package khatru
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// HandleFirehose streams every event accepted by the relay as server-sent events.
+// Only requests authenticated with NIP-98 by one of the FirehoseAdmins are allowed.
+// Events are dropped for clients that can't keep up instead of slowing down the relay.
+func (rl *Relay) HandleFirehose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pubkey, err := rl.validateNIP98(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !slices.Contains(rl.FirehoseAdmins, pubkey) {
+		http.Error(w, "not allowed", http.StatusForbidden)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// this is a long-lived response, so get rid of any server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := make(chan *nostr.Event, 256)
+	rl.firehose.Store(ch, struct{}{})
+	defer rl.firehose.Delete(ch)
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-rl.shutdown:
+			return
+		case evt := <-ch:
+			b, _ := json.Marshal(evt)
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// sendToFirehose hands the event to all firehose clients, dropping it for those whose buffer is full
+func (rl *Relay) sendToFirehose(evt *nostr.Event) {
+	// a copy, since the event may still be modified by OverwriteResponseEvent after this
+	c := *evt
+	rl.firehose.Range(func(ch chan *nostr.Event, _ struct{}) bool {
+		select {
+		case ch <- &c:
+		default:
+		}
+		return true
+	})
+}
@@ -3,18 +3,20 @@ package khatru
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/fasthttp/websocket"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
 	"github.com/nbd-wtf/go-nostr/nip42"
+	"github.com/puzpuzpuz/xsync/v3"
 	"github.com/rs/cors"
 )
 
@@ -28,18 +30,85 @@ func (rl *Relay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		rl.HandleWebsocket(w, r)
 	} else if r.Header.Get("Accept") == "application/nostr+json" {
 		cors.AllowAll().Handler(http.HandlerFunc(rl.HandleNIP11)).ServeHTTP(w, r)
+	} else if r.URL.Path == "/firehose" && len(rl.FirehoseAdmins) > 0 {
+		rl.HandleFirehose(w, r)
+	} else if r.URL.Path == "/info/features" && rl.ServeFeatures {
+		rl.HandleFeatures(w, r)
+	} else if r.URL.Path == "/event" && r.Method == http.MethodPost && rl.EnableHTTPPublish {
+		rl.HandlePublish(w, r)
+	} else if r.URL.Path == "/events" && r.Method == http.MethodGet && rl.EnableHTTPQuery {
+		cors.AllowAll().Handler(http.HandlerFunc(rl.HandleQuery)).ServeHTTP(w, r)
+	} else if r.URL.Path == "/compression/dictionary" && rl.CompressionDictionary != nil {
+		rl.HandleCompressionDictionary(w, r)
 	} else {
 		rl.serveMux.ServeHTTP(w, r)
 	}
 }
 
 func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := rl.upgrader.Upgrade(w, r, nil)
+	if rl.shuttingDown.Load() {
+		http.Error(w, "relay is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// this runs before anything else so it is cheap to reject connections
+	for _, reject := range rl.RejectConnection {
+		if reject(r) {
+			http.Error(w, "connection rejected", http.StatusForbidden)
+			return
+		}
+	}
+
+	upgrader := rl.upgrader
+	upgrader.EnableCompression = rl.EnableCompression
+	if len(rl.Subprotocols) > 0 {
+		if requested := websocket.Subprotocols(r); len(requested) > 0 && !slices.ContainsFunc(requested,
+			func(p string) bool { return slices.Contains(rl.Subprotocols, p) }) {
+			http.Error(w, "unsupported websocket subprotocol", http.StatusBadRequest)
+			return
+		}
+		upgrader.Subprotocols = rl.Subprotocols
+	}
+
+	// features declared by the client that we also support
+	supported := rl.ConnectionFeatures
+	if rl.CompressionDictionary != nil {
+		supported = append(slices.Clip(supported), CompressionDictionaryFeature)
+	}
+	if rl.SignedDelivery && rl.SelfSecretKey != "" {
+		supported = append(slices.Clip(supported), AttestationFeature)
+	}
+	features := negotiateFeatures(r.Header.Get("X-Nostr-Features"), supported)
+	var responseHeader http.Header
+	if len(features) > 0 {
+		responseHeader = http.Header{"X-Nostr-Features": []string{strings.Join(features, ", ")}}
+	}
+
+	if rl.MaxConcurrentUpgrades > 0 {
+		rl.upgradeSlotsOnce.Do(func() {
+			rl.upgradeSlots = make(chan struct{}, rl.MaxConcurrentUpgrades)
+		})
+		select {
+		case rl.upgradeSlots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many connections being established, try again", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
+	if rl.MaxConcurrentUpgrades > 0 {
+		<-rl.upgradeSlots
+	}
 	if err != nil {
 		rl.Log.Printf("failed to upgrade websocket: %v\n", err)
 		return
 	}
-	rl.clients.Store(conn, struct{}{})
+	if rl.EnableCompression {
+		// this is a no-op if the client didn't negotiate permessage-deflate
+		conn.EnableWriteCompression(true)
+	}
 	ticker := time.NewTicker(rl.PingPeriod)
 
 	// NIP-42 challenge
@@ -47,11 +116,52 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 	rand.Read(challenge)
 
 	ws := &WebSocket{
-		conn:      conn,
-		Request:   r,
-		Challenge: hex.EncodeToString(challenge),
+		conn:        conn,
+		Request:     r,
+		Challenge:   hex.EncodeToString(challenge),
+		Subprotocol: conn.Subprotocol(),
+		features:    features,
+	}
+	if rl.EnableCompression {
+		ws.compressionMinSize = rl.CompressionMinSize
+	}
+	if rl.ResolveConnectionTier != nil {
+		ws.Tier = rl.ResolveConnectionTier(r)
+	}
+	if ws.HasFeature(CompressionDictionaryFeature) {
+		ws.dictionary = rl.CompressionDictionary
+	}
+	if ws.HasFeature(AttestationFeature) {
+		ws.attester = rl.getAttester()
+	}
+	if rl.MaxTotalOutgoingBytes > 0 {
+		rl.outgoingOnce.Do(func() {
+			rl.outgoing = &outgoingLimiter{rl: rl}
+		})
+		ws.outgoing = rl.outgoing
+	}
+	if rl.WriteQueueSize > 0 {
+		ws.queue = make(chan queuedMessage, rl.WriteQueueSize)
+	}
+	if rl.EnableNegentropy {
+		ws.negentropy = xsync.NewMapOf[string, *negentropySession]()
 	}
 
+	// the upgrade takes a while, so Shutdown may have started since we checked above
+	rl.shutdownLock.Lock()
+	if rl.shuttingDown.Load() {
+		rl.shutdownLock.Unlock()
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shutting down"),
+			time.Now().Add(time.Second))
+		conn.Close()
+		ticker.Stop()
+		return
+	}
+	rl.clients.Store(conn, ws)
+	rl.connections.Add(2)
+	rl.shutdownLock.Unlock()
+
 	ctx, cancel := context.WithCancel(
 		context.WithValue(
 			context.Background(),
@@ -74,6 +184,7 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	go func() {
+		defer rl.connections.Done()
 		defer kill()
 
 		conn.SetReadLimit(rl.MaxMessageSize)
@@ -103,111 +214,174 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			received := time.Now()
+			ws.lastActivity.Store(received.Unix())
+
 			if typ == websocket.PingMessage {
 				ws.WriteMessage(websocket.PongMessage, nil)
 				continue
 			}
 
+			// binary frames are handled just like text frames, as some clients send JSON in them
 			go func(message []byte) {
+				if rl.handleNegentropyMessage(ctx, ws, message) {
+					return
+				}
+
 				envelope := nostr.ParseMessage(message)
 				if envelope == nil {
-					// stop silently
+					if rl.NoticeOnInvalidMessage {
+						ws.WriteJSON(nostr.NoticeEnvelope(Reason(PrefixError, "could not parse your message")))
+					}
 					return
 				}
 
+				if rl.Metrics != nil {
+					rl.countMessage(envelope)
+				}
+
 				switch env := envelope.(type) {
 				case *nostr.EventEnvelope:
-					// check id
-					hash := sha256.Sum256(env.Event.Serialize())
-					id := hex.EncodeToString(hash[:])
-					if id != env.Event.ID {
-						ws.WriteJSON(nostr.OKEnvelope{EventID: env.Event.ID, OK: false, Reason: "invalid: id is computed incorrectly"})
-						return
-					}
-
-					// check signature
-					if ok, err := env.Event.CheckSignature(); err != nil {
-						ws.WriteJSON(nostr.OKEnvelope{EventID: env.Event.ID, OK: false, Reason: "error: failed to verify signature"})
-						return
-					} else if !ok {
-						ws.WriteJSON(nostr.OKEnvelope{EventID: env.Event.ID, OK: false, Reason: "invalid: signature is invalid"})
-						return
-					}
-
 					var ok bool
-					var writeErr error
-					if env.Event.Kind == 5 {
-						// this always returns "blocked: " whenever it returns an error
-						writeErr = rl.handleDeleteRequest(ctx, &env.Event)
-					} else {
-						// this will also always return a prefixed reason
-						writeErr = rl.AddEvent(ctx, &env.Event)
-					}
-
 					var reason string
-					if writeErr == nil {
+					var latency time.Duration
+					ectx := context.WithValue(ctx, receivedAtKey, received)
+					if rl.VerboseOK {
+						ectx = context.WithValue(ectx, storeLatencyKey, &latency)
+					}
+					if err := rl.handleEvent(ectx, &env.Event); err == nil {
 						ok = true
-						for _, ovw := range rl.OverwriteResponseEvent {
-							ovw(ctx, &env.Event)
+						if latency > 0 {
+							reason = ": stored in " + formatLatency(latency)
 						}
-						notifyListeners(&env.Event)
 					} else {
-						reason = writeErr.Error()
-						if strings.HasPrefix(reason, "auth-required:") {
-							RequestAuth(ctx)
+						reason = err.Error()
+						if HasReasonPrefix(reason, PrefixAuthRequired) {
+							requestAuthIfNeeded(ctx, ws)
 						}
+
+						// NIP-01 says duplicates are accepted, as the relay has the event anyway
+						ok = HasReasonPrefix(reason, PrefixDuplicate)
 					}
 					ws.WriteJSON(nostr.OKEnvelope{EventID: env.Event.ID, OK: ok, Reason: reason})
 				case *nostr.CountEnvelope:
-					if rl.CountEvents == nil {
-						ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: "unsupported: this relay does not support NIP-45"})
+					if rl.CountEvents == nil && rl.CountEventsHLL == nil {
+						ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: Reason(PrefixUnsupported, "this relay does not support NIP-45")})
 						return
 					}
-					var total int64
-					for _, filter := range env.Filters {
-						total += rl.handleCountRequest(ctx, ws, filter)
+					if rl.shedRead() {
+						ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: errOverloaded.Error()})
+						return
+					}
+					if err := rl.checkWriteOnly(ctx); err != nil {
+						reason := err.Error()
+						if HasReasonPrefix(reason, PrefixAuthRequired) {
+							requestAuthIfNeeded(ctx, ws)
+						}
+						ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: reason})
+						return
 					}
-					ws.WriteJSON(nostr.CountEnvelope{SubscriptionID: env.SubscriptionID, Count: &total})
-				case *nostr.ReqEnvelope:
-					eose := sync.WaitGroup{}
-					eose.Add(len(env.Filters))
-
-					// a context just for the "stored events" request handler
-					reqCtx, cancelReqCtx := context.WithCancelCause(ctx)
-
-					// expose subscription id in the context
-					reqCtx = context.WithValue(reqCtx, subscriptionIdKey, env.SubscriptionID)
 
-					// handle each filter separately -- dispatching events as they're loaded from databases
-					for _, filter := range env.Filters {
-						err := rl.handleRequest(reqCtx, env.SubscriptionID, &eose, ws, filter)
+					// all filters are checked before anything is counted, so a rejected filter
+					// doesn't leave the others running for nothing
+					filters := make([]nostr.Filter, len(env.Filters))
+					for i, filter := range env.Filters {
+						var err error
+						filters[i], err = rl.prepareCountFilter(ctx, filter)
 						if err != nil {
-							// fail everything if any filter is rejected
 							reason := err.Error()
-							if strings.HasPrefix(reason, "auth-required:") {
-								RequestAuth(ctx)
+							if HasReasonPrefix(reason, PrefixAuthRequired) {
+								requestAuthIfNeeded(ctx, ws)
 							}
 							ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: reason})
-							cancelReqCtx(errors.New("filter rejected"))
 							return
 						}
 					}
 
-					go func() {
-						// when all events have been loaded from databases and dispatched
-						// we can cancel the context and fire the EOSE message
-						eose.Wait()
-						cancelReqCtx(nil)
-						ws.WriteJSON(nostr.EOSEEnvelope(env.SubscriptionID))
-					}()
+					var total int64
+					var hll *HyperLogLog
+					var approximate bool
+					for i, filter := range filters {
+						res, fhll, capped, err := rl.handleCountRequest(ctx, ws, filter)
+						if err != nil {
+							reason := err.Error()
+							if HasReasonPrefix(reason, PrefixAuthRequired) {
+								requestAuthIfNeeded(ctx, ws)
+							}
+							ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: reason})
+							return
+						}
+						total += res
+						approximate = approximate || capped
 
-					setListener(env.SubscriptionID, ws, env.Filters, cancelReqCtx)
+						// registers are only meaningful if all filters produced them with the same offset
+						if i == 0 {
+							hll = fhll
+						} else if hll != nil && fhll != nil && hll.offset == fhll.offset {
+							hll.Merge(fhll)
+						} else {
+							hll = nil
+						}
+					}
+					if rl.MaxCount > 0 && total > rl.MaxCount {
+						// each filter was capped on its own, the sum must be too
+						total = rl.MaxCount
+						approximate = true
+					}
+					if approximate {
+						hll = nil
+					}
+					ws.WriteJSON(countResponse{SubscriptionID: env.SubscriptionID, Count: total, Approximate: approximate, HLL: hll})
+				case *nostr.ReqEnvelope:
+					if !isValidSubscriptionID(env.SubscriptionID) {
+						ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: invalidSubscriptionID})
+						return
+					}
+					if rl.shedRead() {
+						ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: errOverloaded.Error()})
+						return
+					}
+					if rl.tooMuchChurn(ws) {
+						ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: Reason(PrefixBlocked, "subscription churn limit exceeded")})
+						return
+					}
+					rl.handleReq(ctx, ws, env, true)
 				case *nostr.CloseEnvelope:
-					removeListenerId(ws, string(*env))
+					if !isValidSubscriptionID(string(*env)) {
+						ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: string(*env), Reason: invalidSubscriptionID})
+						return
+					}
+					if !removeListenerId(ws, string(*env)) && rl.NoticeOnUnknownClose {
+						ws.WriteJSON(nostr.NoticeEnvelope("no such subscription"))
+					}
 				case *nostr.AuthEnvelope:
-					wsBaseUrl := strings.Replace(rl.ServiceURL, "http", "ws", 1)
-					if pubkey, ok := nip42.ValidateAuthEvent(&env.Event, ws.Challenge, wsBaseUrl); ok {
+					if reason := rl.tooManyAuthAttempts(ctx, ws); reason != "" {
+						ws.WriteJSON(nostr.OKEnvelope{EventID: env.Event.ID, OK: false, Reason: reason})
+						return
+					}
+
+					var pubkey string
+					var ok bool
+					if rl.ValidateAuth != nil {
+						pubkey, ok = rl.ValidateAuth(ctx, &env.Event, ws.Challenge)
+					} else if relayTag := env.Event.Tags.GetFirst([]string{"relay", ""}); relayTag != nil {
+						wsBaseUrl := strings.Replace(rl.ServiceURL, "http", "ws", 1)
+						for _, accepted := range rl.AcceptedAuthURLs {
+							if normalizeURL(accepted) == normalizeURL(relayTag.Value()) {
+								wsBaseUrl = accepted
+								break
+							}
+						}
+						pubkey, ok = nip42.ValidateAuthEvent(&env.Event, ws.Challenge, wsBaseUrl)
+					}
+					if ok {
+						ws.authLock.Lock()
 						ws.AuthedPublicKey = pubkey
+						ws.authLock.Unlock()
+						// run these before waking up anyone waiting for auth
+						for _, onauth := range rl.OnAuth {
+							onauth(ctx, pubkey)
+						}
 						ws.authLock.Lock()
 						if ws.Authed != nil {
 							close(ws.Authed)
@@ -216,7 +390,7 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 						ws.authLock.Unlock()
 						ws.WriteJSON(nostr.OKEnvelope{EventID: env.Event.ID, OK: true})
 					} else {
-						ws.WriteJSON(nostr.OKEnvelope{EventID: env.Event.ID, OK: false, Reason: "error: failed to authenticate"})
+						ws.WriteJSON(nostr.OKEnvelope{EventID: env.Event.ID, OK: false, Reason: Reason(PrefixError, "failed to authenticate")})
 					}
 				}
 			}(message)
@@ -224,32 +398,396 @@ func (rl *Relay) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	go func() {
+		defer rl.connections.Done()
 		defer kill()
+		if ws.queue != nil {
+			defer ws.closeQueue()
+		}
+
+		// clients get the challenge right away so the grace period counts from it
+		var authDeadline <-chan time.Time
+		if rl.UnauthenticatedGracePeriod > 0 {
+			RequestAuth(ctx)
+			var stop func() bool
+			authDeadline, stop = rl.startTimer(rl.UnauthenticatedGracePeriod)
+			defer stop()
+		}
 
 		for {
 			select {
 			case <-ctx.Done():
 				return
+			case msg := <-ws.queue:
+				if err := ws.write(msg.typ, msg.data); err != nil || msg.typ == websocket.CloseMessage {
+					return
+				}
+			case <-authDeadline:
+				if ws.authedPubKey() == "" {
+					ws.conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.ClosePolicyViolation, Reason(PrefixAuthRequired, "authentication timeout")),
+						time.Now().Add(rl.WriteWait))
+					return
+				}
 			case <-ticker.C:
-				err := ws.WriteMessage(websocket.PingMessage, nil)
+				err := ws.write(websocket.PingMessage, nil)
 				if err != nil {
 					if !strings.HasSuffix(err.Error(), "use of closed network connection") {
 						rl.Log.Printf("error writing ping: %v; closing websocket\n", err)
 					}
 					return
 				}
+
+				if rl.SubscriptionIdleTimeout > 0 {
+					// a subscription is idle when neither it nor the client have done anything for a while
+					idleSince := time.Now().Add(-rl.SubscriptionIdleTimeout)
+					if ws.lastActivity.Load() < idleSince.Unix() {
+						closeIdleListeners(ws, idleSince)
+					}
+				}
 			}
 		}
 	}()
 }
 
+// tooManyAuthAttempts counts an AUTH attempt and returns the rejection reason if it goes over the configured limits.
+func (rl *Relay) tooManyAuthAttempts(ctx context.Context, ws *WebSocket) string {
+	ws.authLock.Lock()
+	ws.authAttempts++
+	attempts := ws.authAttempts
+	ws.authLock.Unlock()
+	if rl.MaxAuthAttemptsPerConnection > 0 && attempts > rl.MaxAuthAttemptsPerConnection {
+		return Reason(PrefixAuthRequired, "too many attempts")
+	}
+
+	if rl.MaxAuthAttemptsPerIP > 0 && rl.authAttempts.hit(GetIP(ctx), rl.AuthAttemptsWindow) > rl.MaxAuthAttemptsPerIP {
+		return StructuredReason(PrefixRateLimited, "too many auth attempts", map[string]string{
+			ReasonFieldRetryAfter: strconv.Itoa(int(rl.AuthAttemptsWindow.Seconds())),
+		})
+	}
+
+	return ""
+}
+
+// tooMuchChurn counts a REQ and tells if the connection went over MaxSubscriptionChurn.
+func (rl *Relay) tooMuchChurn(ws *WebSocket) bool {
+	if rl.MaxSubscriptionChurn <= 0 {
+		return false
+	}
+	decay := rl.SubscriptionChurnDecay
+	if decay <= 0 {
+		decay = time.Minute
+	}
+
+	ws.churnLock.Lock()
+	defer ws.churnLock.Unlock()
+
+	now := time.Now()
+	if !ws.churnUpdated.IsZero() {
+		ws.churn = max(0, ws.churn-float64(now.Sub(ws.churnUpdated))/float64(decay))
+	}
+	ws.churnUpdated = now
+	if ws.churn+1 > float64(rl.MaxSubscriptionChurn) {
+		return true
+	}
+	ws.churn++
+	return false
+}
+
+// handleEvent handles an EVENT message: it checks the event, adds it (or processes the deletion) and then
+// broadcasts it to listeners. The returned error always has a prefixed reason suitable for an OK message.
+func (rl *Relay) handleEvent(ctx context.Context, evt *nostr.Event) error {
+	if rl.Metrics != nil {
+		rl.Metrics.EventsReceived.Add(1)
+		err := rl.processEvent(ctx, evt)
+		if err == nil {
+			rl.Metrics.EventsAccepted.Add(1)
+		} else {
+			rl.Metrics.EventsRejected.Add(1)
+		}
+		return err
+	}
+	return rl.processEvent(ctx, evt)
+}
+
+// processEvent does the actual work of handleEvent, without metrics
+func (rl *Relay) processEvent(ctx context.Context, evt *nostr.Event) error {
+	// this is checked before anything else such that a flood costs us as little as possible
+	if rl.EventIPLimiter != nil && !rl.EventIPLimiter.Allow(GetIP(ctx)) {
+		return RejectRateLimited("slow down")
+	}
+
+	if rl.shedWrite() {
+		return errOverloaded
+	}
+
+	// check id and signature
+	if reason := rl.verifyEvent(evt); reason != "" {
+		return errors.New(reason)
+	}
+
+	if evt.Kind == 5 && rl.HandleDeletionsInternally {
+		// this always returns "blocked: " whenever it returns an error
+		if err := rl.handleDeleteRequest(ctx, evt); err != nil {
+			return err
+		}
+	} else {
+		// this will also always return a prefixed reason
+		if err := rl.AddEvent(ctx, evt); err != nil {
+			return err
+		}
+	}
+
+	rl.sendToFirehose(evt)
+	for _, ovw := range rl.OverwriteResponseEvent {
+		ovw(ctx, evt)
+	}
+	if rl.MaxDeliveryFutureDrift == 0 || time.Until(evt.CreatedAt.Time()) <= rl.MaxDeliveryFutureDrift {
+		rl.notifyListeners(evt)
+	}
+
+	return nil
+}
+
+// handleReq handles a REQ message: it dispatches stored events for each filter,
+// sends EOSE and registers the subscription for live events.
+func (rl *Relay) handleReq(ctx context.Context, ws *WebSocket, env *nostr.ReqEnvelope, retryAfterAuth bool) {
+	// taken before anything is queried, so events that arrive while we do that are not missed by clients
+	// that resume from it
+	receivedAt := nostr.Now()
+
+	// the context of the subscription, with its id exposed, which is only canceled when it's closed or replaced
+	subCtx, cancelSubCtx := context.WithCancelCause(context.WithValue(ctx, subscriptionIdKey, env.SubscriptionID))
+
+	// a context just for the "stored events" request handler, which is also canceled after the EOSE
+	reqCtx, cancelReqCtx := context.WithCancelCause(subCtx)
+
+	// the same filter sent more than once in a REQ is only handled once
+	filters := env.Filters
+	if !rl.KeepDuplicateFilters {
+		filters = uniqueFilters(filters)
+	}
+
+	// when all events have been loaded from databases and dispatched
+	// we can cancel the context and fire the EOSE message
+	liveOnly := rl.AllowLiveOnlyMode && isLiveOnly(filters)
+	stored := &subscriptionWriter{ctx: reqCtx, cancel: cancelReqCtx, w: ws}
+	stop := func(cause error) {
+		cancelSubCtx(cause)
+		stored.stop(cause)
+	}
+	var writer jsonWriter = stored
+	var buffer *priorityBuffer
+	if len(rl.DeliveryPriority) > 0 && !liveOnly {
+		buffer = &priorityBuffer{w: stored, priority: rl.DeliveryPriority}
+		writer = buffer
+	}
+	eose := newEOSECounter(len(filters), func() {
+		if stored.stopped() {
+			return
+		}
+		if buffer != nil {
+			buffer.flush()
+		}
+		if !liveOnly {
+			if rl.AppendServerTimeToEOSE {
+				stored.WriteJSON(eoseWithTimeEnvelope{SubscriptionID: env.SubscriptionID, ServerTime: receivedAt})
+			} else {
+				stored.WriteJSON(nostr.EOSEEnvelope(env.SubscriptionID))
+			}
+		}
+		cancelReqCtx(nil)
+	})
+
+	placeholder, previous, ok := reserveListener(env.SubscriptionID, ws, rl.MaxSubscriptions, stop)
+	if !ok {
+		ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: Reason(PrefixRateLimited, "too many concurrent subscriptions")})
+		stop(errors.New("too many subscriptions"))
+		return
+	}
+	if previous != nil {
+		// a REQ with the same id replaces the previous one, whatever it was still sending is dropped
+		// before we start so the events of both are never mixed
+		previous.cancel(errSubscriptionReplaced)
+	}
+
+	// handle each filter separately -- dispatching events as they're loaded from databases
+	pinned := &pinnedEvents{}
+	for _, filter := range filters {
+		var err error
+		if liveOnly {
+			err = rl.checkLiveOnlyFilter(reqCtx, filter)
+			eose.done()
+		} else {
+			err = rl.handleRequest(reqCtx, env.SubscriptionID, eose, writer, filter, pinned)
+		}
+		if err != nil {
+			// fail everything if any filter is rejected
+			reason := err.Error()
+			if HasReasonPrefix(reason, PrefixAuthRequired) && requestAuthIfNeeded(ctx, ws) {
+				if retryAfterAuth && rl.AutoRetryAfterAuth > 0 {
+					ws.authLock.Lock()
+					authed := ws.Authed
+					ws.authLock.Unlock()
+					go rl.retryReqAfterAuth(ctx, ws, env, authed)
+				}
+			}
+			// stopped before the CLOSED so nothing the other filters were still sending comes after it
+			releaseListener(env.SubscriptionID, ws, placeholder)
+			stop(errors.New("filter rejected"))
+			ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: env.SubscriptionID, Reason: reason})
+			if err == errBackendUnavailable {
+				// every other subscription is closed too, so all clients resubscribe once the storage is back
+				rl.BackendUnavailable()
+			}
+			return
+		}
+	}
+
+	var throttle *deliveryThrottle
+	if rate := rl.deliveryRate(reqCtx); rate != nil {
+		throttle = newDeliveryThrottle(ctx, *rate, rl.Metrics)
+	}
+	if !setListener(subCtx, env.SubscriptionID, ws, filters, stop, throttle, placeholder) {
+		// closed or replaced while the stored events were loading, so it's gone already
+		return
+	}
+	if rl.SendLiveStartedMarker {
+		ws.WriteJSON(liveStartedEnvelope(env.SubscriptionID))
+	}
+	for _, onsub := range rl.OnSubscription {
+		onsub(reqCtx, ws, env.SubscriptionID, filters)
+	}
+
+	// all filters were dispatched, release our own hold on the EOSE
+	// (if any filter was rejected above we never get here and EOSE is never sent)
+	eose.done()
+}
+
+// startTimer is like time.NewTimer, unless the timers were replaced by a fake clock
+func (rl *Relay) startTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	if rl.timers != nil {
+		return rl.timers(d)
+	}
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// eoseWithTimeEnvelope is an EOSE with the time the REQ was received, see AppendServerTimeToEOSE
+type eoseWithTimeEnvelope struct {
+	SubscriptionID string
+	ServerTime     nostr.Timestamp
+}
+
+func (v eoseWithTimeEnvelope) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{"EOSE", v.SubscriptionID, v.ServerTime})
+}
+
+// liveStartedEnvelope tells live events are being sent to a subscription, see SendLiveStartedMarker
+type liveStartedEnvelope string
+
+func (v liveStartedEnvelope) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{"LIVE", string(v)})
+}
+
+// retryReqAfterAuth waits for the client to authenticate within AutoRetryAfterAuth
+// and then handles the given REQ again (only once).
+func (rl *Relay) retryReqAfterAuth(ctx context.Context, ws *WebSocket, env *nostr.ReqEnvelope, authed chan struct{}) {
+	if authed == nil {
+		// the client may have authenticated already before we could get the channel
+		if ws.authedPubKey() != "" {
+			rl.handleReq(ctx, ws, env, false)
+		}
+		return
+	}
+
+	timer := time.NewTimer(rl.AutoRetryAfterAuth)
+	defer timer.Stop()
+
+	select {
+	case <-authed:
+		rl.handleReq(ctx, ws, env, false)
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
 func (rl *Relay) HandleNIP11(w http.ResponseWriter, r *http.Request) {
+	if rl.HideNIP11 != nil && rl.HideNIP11(r) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// without OverwriteRelayInformation functions the document doesn't depend on the request
+	// so it can be cached, otherwise it's rendered for each request
+	var body []byte
+	var etag string
+	if len(rl.OverwriteRelayInformation) == 0 {
+		body, etag = rl.nip11Cache.get(func() []byte { return rl.renderNIP11(r) })
+	} else {
+		body = rl.renderNIP11(r)
+		etag = nip11ETag(body)
+	}
+
 	w.Header().Set("Content-Type", "application/nostr+json")
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body)
+}
 
-	info := *rl.Info
+func (rl *Relay) renderNIP11(r *http.Request) []byte {
+	// the parts that depend on the configuration are computed on every render,
+	// and the OverwriteRelayInformation functions still get the last word
+	info := rl.applyLiveConfig(*rl.Info)
 	for _, ovw := range rl.OverwriteRelayInformation {
 		info = ovw(r.Context(), r, info)
 	}
 
-	json.NewEncoder(w).Encode(info)
+	doc := nip11Document{RelayInformationDocument: info, PubKey: info.PubKey, Icon: info.Icon, Self: rl.Self, WriteOnly: rl.WriteOnly}
+	if rl.SelfSecretKey != "" {
+		if self, sig, err := signServiceURL(rl.SelfSecretKey, rl.ServiceURL); err != nil {
+			rl.Log.Printf("failed to sign NIP-11 self proof: %v\n", err)
+		} else {
+			// the signature only proves the key it was made with
+			doc.Self = self
+			doc.SelfSig = sig
+		}
+	}
+
+	body, _ := json.Marshal(doc)
+	return append(body, '\n')
+}
+
+// nip11Document extends the base NIP-11 document with the relay identity and
+// mode fields and makes "pubkey" and "icon" optional
+type nip11Document struct {
+	nip11.RelayInformationDocument
+
+	PubKey  string `json:"pubkey,omitempty"`
+	Icon    string `json:"icon,omitempty"`
+	Self    string `json:"self,omitempty"`
+	SelfSig string `json:"self_sig,omitempty"`
+
+	WriteOnly bool `json:"write_only,omitempty"`
+}
+
+const invalidSubscriptionID = PrefixInvalid + ": subscription id must be a non-empty string of up to 64 characters"
+
+// isValidSubscriptionID checks the subscription id as NIP-01 defines it
+func isValidSubscriptionID(id string) bool {
+	return id != "" && len(id) <= 64
+}
+
+// formatLatency rounds a duration to something readable, like 12ms or 850µs
+func formatLatency(d time.Duration) string {
+	switch {
+	case d >= time.Millisecond:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Microsecond:
+		return d.Round(time.Microsecond).String()
+	default:
+		return d.String()
+	}
 }
@@ -0,0 +1,329 @@
+package khatru
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// blockingQuery makes the QueryEvents of the relay hang on the first query for the given kind until release
+// is closed, regardless of the context, and reports when the query has happened so the tests can change the
+// subscription while its stored events are still loading
+type blockingQuery struct {
+	kind     int
+	started  chan struct{}
+	release  chan struct{}
+	finished atomic.Bool
+	once     sync.Once
+}
+
+func blockQueries(rl *Relay, store *memoryStore, kind int) *blockingQuery {
+	bq := &blockingQuery{kind: kind, started: make(chan struct{}), release: make(chan struct{})}
+	rl.QueryEvents = []func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error){
+		func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+			if len(filter.Kinds) != 1 || filter.Kinds[0] != bq.kind {
+				return store.QueryEvents(ctx, filter)
+			}
+			blocked := false
+			bq.once.Do(func() { blocked = true })
+			if !blocked {
+				return store.QueryEvents(ctx, filter)
+			}
+			close(bq.started)
+			<-bq.release
+
+			ch, _ := store.QueryEvents(ctx, filter)
+			out := make(chan *nostr.Event)
+			go func() {
+				defer bq.finished.Store(true)
+				defer close(out)
+				for evt := range ch {
+					out <- evt
+				}
+			}()
+			return out, nil
+		},
+	}
+	return bq
+}
+
+// waitForLoading waits until the blocked query has been released and returned its events, plus a little
+// more for the REQ handler to get to the end
+func (bq *blockingQuery) waitForLoading(t *testing.T) {
+	close(bq.release)
+	waitFor(t, "blocked query", bq.finished.Load)
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestReqReplacedWhileLoading(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.SendLiveStartedMarker = true
+	var subscribed []nostr.Filters
+	var subscribedLock sync.Mutex
+	rl.OnSubscription = append(rl.OnSubscription, func(ctx context.Context, ws *WebSocket, id string, filters nostr.Filters) {
+		subscribedLock.Lock()
+		defer subscribedLock.Unlock()
+		subscribed = append(subscribed, filters)
+	})
+	for i := 0; i < 3; i++ {
+		store.StoreEvent(context.Background(), mkev(t, 1, "old", nil))
+		store.StoreEvent(context.Background(), mkev(t, 2, "new", nil))
+	}
+	bq := blockQueries(rl, store, 1)
+
+	url := serve(t, rl)
+	client := dial(t, url)
+	publisher := dial(t, url)
+
+	client.send("REQ", "a", nostr.Filter{Kinds: []int{1}})
+	<-bq.started
+	client.send("REQ", "a", nostr.Filter{Kinds: []int{2}})
+
+	_, before := client.until("EOSE")
+	stored := 0
+	for _, msg := range before {
+		if messageLabel(msg) == "LIVE" {
+			continue
+		}
+		stored++
+		if evt := messageEvent(t, msg); evt.Kind != 2 {
+			t.Fatalf("got a kind %d event from the replaced subscription", evt.Kind)
+		}
+	}
+	if stored != 3 {
+		t.Fatalf("expected 3 stored events, got %d", stored)
+	}
+
+	bq.waitForLoading(t)
+
+	// the replaced REQ must not take over the live subscription
+	publisher.send("EVENT", mkev(t, 1, "live old", nil))
+	publisher.until("OK")
+	publisher.send("EVENT", mkev(t, 2, "live new", nil))
+	publisher.until("OK")
+
+	msg, before := client.until("EVENT")
+	if evt := messageEvent(t, msg); evt.Kind != 2 || evt.Content != "live new" {
+		t.Fatalf("expected the live kind 2 event, got %v", evt)
+	}
+	for _, msg := range before {
+		t.Fatalf("unexpected message %s", msg)
+	}
+	if msg := client.read(100 * time.Millisecond); msg != nil {
+		t.Fatalf("unexpected message %s", msg)
+	}
+
+	if n := rl.ActiveSubscriptions(); n != 1 {
+		t.Fatalf("expected 1 active subscription, got %d", n)
+	}
+	subscribedLock.Lock()
+	defer subscribedLock.Unlock()
+	if len(subscribed) != 1 || subscribed[0][0].Kinds[0] != 2 {
+		t.Fatalf("OnSubscription should have been called only for the second REQ, got %v", subscribed)
+	}
+}
+
+func TestReqClosedWhileLoading(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.SendLiveStartedMarker = true
+	store.StoreEvent(context.Background(), mkev(t, 1, "old", nil))
+	bq := blockQueries(rl, store, 1)
+
+	url := serve(t, rl)
+	client := dial(t, url)
+	publisher := dial(t, url)
+
+	client.send("REQ", "a", nostr.Filter{Kinds: []int{1}})
+	<-bq.started
+	client.send("CLOSE", "a")
+	waitFor(t, "CLOSE", func() bool { return rl.ActiveSubscriptions() == 0 })
+
+	bq.waitForLoading(t)
+	if n := rl.ActiveSubscriptions(); n != 0 {
+		t.Fatalf("the closed subscription was registered again, %d active", n)
+	}
+
+	publisher.send("EVENT", mkev(t, 1, "live", nil))
+	publisher.until("OK")
+
+	// neither the stored events, the EOSE, the LIVE marker or the live event should arrive after the CLOSE
+	if msg := client.read(200 * time.Millisecond); msg != nil {
+		t.Fatalf("got %s after the CLOSE", msg)
+	}
+}
+
+func TestNothingSentAfterAFilterIsRejected(t *testing.T) {
+	rl, store := newTestRelay()
+	for i := 0; i < 3; i++ {
+		store.StoreEvent(context.Background(), mkev(t, 1, "stored", nil))
+	}
+	// the events only come after the REQ was rejected, and the storage doesn't care about the context
+	release := make(chan struct{})
+	rl.QueryEvents = []func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error){
+		func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+			results := store.matching(filter)
+			ch := make(chan *nostr.Event)
+			go func() {
+				defer close(ch)
+				<-release
+				for _, evt := range results {
+					ch <- evt
+				}
+			}()
+			return ch, nil
+		},
+	}
+	rl.RejectFilter = append(rl.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		return slices.Contains(filter.Kinds, 2), "blocked: no kind 2"
+	})
+	client := dial(t, serve(t, rl))
+
+	client.send("REQ", "a", nostr.Filter{Kinds: []int{1}}, nostr.Filter{Kinds: []int{2}})
+	if msg, before := client.until("CLOSED"); string(msg[2]) != `"blocked: no kind 2"` || len(before) != 1 {
+		t.Fatalf("unexpected CLOSED %s after %s", msg, before)
+	}
+	close(release)
+	if msg := client.read(200 * time.Millisecond); msg != nil {
+		t.Fatalf("got %s after the CLOSED", msg)
+	}
+}
+
+func TestUnauthenticatedGracePeriod(t *testing.T) {
+	rl, _ := newTestRelay()
+	rl.ValidateAuth = acceptAnyAuth
+	rl.UnauthenticatedGracePeriod = time.Minute
+	clock := &fakeClock{}
+	rl.timers = clock.timer
+	url := serve(t, rl)
+
+	anonymous := dial(t, url)
+	anonymous.until("AUTH")
+	authed := dial(t, url)
+	authed.auth(nostr.GeneratePrivateKey())
+	waitFor(t, "timers", func() bool { return clock.pending() == 2 })
+
+	clock.advance(59 * time.Second)
+	if msg := anonymous.read(100 * time.Millisecond); msg != nil {
+		t.Fatalf("unexpected message %s", msg)
+	}
+	anonymous.send("REQ", "a", nostr.Filter{Kinds: []int{1}})
+	anonymous.until("EOSE")
+
+	clock.advance(time.Second)
+	err := anonymous.closed(2 * time.Second)
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Text != "auth-required: authentication timeout" {
+		t.Fatalf("expected the connection to be closed for not authenticating, got %v", err)
+	}
+
+	authed.send("REQ", "a", nostr.Filter{Kinds: []int{1}})
+	authed.until("EOSE")
+}
+
+func TestOnAuthFiresOncePerAuth(t *testing.T) {
+	rl, _ := newTestRelay()
+	rl.ValidateAuth = acceptAnyAuth
+	var mutex sync.Mutex
+	var authed []string
+	rl.OnAuth = append(rl.OnAuth, func(ctx context.Context, pubkey string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if GetConnection(ctx) == nil {
+			t.Errorf("OnAuth context has no connection")
+		}
+		authed = append(authed, pubkey)
+	})
+	url := serve(t, rl)
+
+	client := dial(t, url)
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	client.send("AUTH", mkev(t, 1, "not an auth event", nil, sk))
+	if msg, _ := client.until("OK"); string(msg[2]) != "false" {
+		t.Fatalf("expected the AUTH to fail, got %s", msg)
+	}
+	client.auth(sk)
+	client.auth(sk)
+	dial(t, url).auth(nostr.GeneratePrivateKey())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(authed) != 3 || authed[0] != pubkey || authed[1] != pubkey {
+		t.Fatalf("expected OnAuth to fire for each of the 3 successful AUTHs, got %v", authed)
+	}
+}
+
+func TestAuthAndConcurrentMessages(t *testing.T) {
+	rl, _ := newTestRelay()
+	rl.ValidateAuth = acceptAnyAuth
+	var mutex sync.Mutex
+	seen := make(map[string]string) // message -> authed pubkey seen by the hooks
+	rl.RejectEvent = append(rl.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		seen[event.Content] = GetAuthed(ctx)
+		return false, ""
+	})
+	rl.RejectFilter = append(rl.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		seen[filter.Search] = GetAuthed(ctx)
+		return false, ""
+	})
+
+	client := dial(t, serve(t, rl))
+	sk := nostr.GeneratePrivateKey()
+	pubkey, _ := nostr.GetPublicKey(sk)
+	burst := func(round string) {
+		for i := 0; i < 10; i++ {
+			client.send("REQ", fmt.Sprintf("%s-%d", round, i), nostr.Filter{Kinds: []int{1}, Search: fmt.Sprintf("req %s %d", round, i)})
+			client.send("EVENT", mkev(t, 1, fmt.Sprintf("event %s %d", round, i), nil))
+		}
+	}
+	drain := func(eoses, oks int) {
+		for eoses > 0 || oks > 0 {
+			msg := client.read(5 * time.Second)
+			switch messageLabel(msg) {
+			case "EOSE":
+				eoses--
+			case "OK":
+				oks--
+			case "":
+				t.Fatalf("timed out")
+			}
+		}
+	}
+
+	// the first messages race with the AUTH, they may see any of the two states
+	client.send("AUTH", mkev(t, 22242, "", nostr.Tags{{"challenge", "-"}}, sk))
+	burst("racing")
+	drain(10, 11)
+	for i := 0; i < 10; i++ {
+		client.send("CLOSE", fmt.Sprintf("racing-%d", i))
+	}
+
+	// but once the AUTH is done all of them see it
+	burst("after")
+	drain(10, 10)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for message, authed := range seen {
+		if authed != "" && authed != pubkey {
+			t.Fatalf("%s saw a wrong pubkey %s", message, authed)
+		}
+		if strings.Contains(message, "after") && authed != pubkey {
+			t.Fatalf("%s didn't see the AUTH", message)
+		}
+	}
+	if len(seen) != 40 {
+		t.Fatalf("expected the hooks to see 40 messages, got %d", len(seen))
+	}
+}
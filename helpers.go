@@ -1,10 +1,15 @@
 package khatru
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/nbd-wtf/go-nostr"
 )
 
@@ -13,6 +18,11 @@ func isOlder(previous, next *nostr.Event) bool {
 		(previous.CreatedAt == next.CreatedAt && previous.ID > next.ID)
 }
 
+// normalizeURL makes URLs comparable regardless of casing, surrounding spaces and trailing slashes
+func normalizeURL(u string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(u)), "/")
+}
+
 func getServiceBaseURL(r *http.Request) string {
 	host := r.Header.Get("X-Forwarded-Host")
 	if host == "" {
@@ -34,3 +44,56 @@ func getServiceBaseURL(r *http.Request) string {
 	}
 	return proto + "://" + host
 }
+
+// signServiceURL returns the public key for the given secret key and a schnorr
+// signature of the sha256 of the given service URL, both hex-encoded.
+func signServiceURL(secretKey string, serviceURL string) (pubkey string, sig string, err error) {
+	s, err := hex.DecodeString(secretKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	sk, _ := btcec.PrivKeyFromBytes(s)
+	h := sha256.Sum256([]byte(serviceURL))
+	signature, err := schnorr.Sign(sk, h[:])
+	if err != nil {
+		return "", "", err
+	}
+
+	pubkey, err = nostr.GetPublicKey(secretKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	return pubkey, hex.EncodeToString(signature.Serialize()), nil
+}
+
+// negotiateFeatures parses a comma-separated list of features declared by the client
+// and returns the ones that are also in supported, lowercased
+func negotiateFeatures(declared string, supported []string) []string {
+	if declared == "" || len(supported) == 0 {
+		return nil
+	}
+
+	features := make([]string, 0, len(supported))
+	for _, feature := range strings.Split(declared, ",") {
+		feature = strings.ToLower(strings.TrimSpace(feature))
+		if feature == "" || slices.Contains(features, feature) {
+			continue
+		}
+		if slices.ContainsFunc(supported, func(s string) bool { return strings.EqualFold(s, feature) }) {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// cloneEvent returns a copy of the event that can be changed without affecting the original
+func cloneEvent(evt *nostr.Event) *nostr.Event {
+	clone := *evt
+	clone.Tags = make(nostr.Tags, len(evt.Tags))
+	for i, tag := range evt.Tags {
+		clone.Tags[i] = slices.Clone(tag)
+	}
+	return &clone
+}
@@ -0,0 +1,96 @@
+package khatru
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/bits"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// HyperLogLog holds the 256 registers of a NIP-45 approximate count, built from the pubkeys
+// of the counted events. Registers built with different offsets can't be merged.
+type HyperLogLog struct {
+	offset    int
+	registers [256]uint8
+}
+
+func NewHyperLogLog(offset int) *HyperLogLog {
+	return &HyperLogLog{offset: offset}
+}
+
+// HyperLogLogOffset returns the offset NIP-45 defines for a filter: if it has a single "#e", "#p", "#a"
+// or "#q" value that is the 32nd character of that value as a nibble plus 8, otherwise 16.
+func HyperLogLogOffset(filter nostr.Filter) int {
+	if len(filter.Tags) == 1 {
+		for name, values := range filter.Tags {
+			switch name {
+			case "e", "p", "a", "q":
+				if len(values) == 1 && len(values[0]) > 32 {
+					if nibble, err := hex.DecodeString("0" + values[0][32:33]); err == nil {
+						return int(nibble[0]) + 8
+					}
+				}
+			}
+		}
+	}
+	return 16
+}
+
+func (h *HyperLogLog) Offset() int { return h.offset }
+
+// Add counts the author of an event, given as a hex pubkey. Invalid pubkeys are ignored.
+func (h *HyperLogLog) Add(pubkey string) {
+	pk, err := hex.DecodeString(pubkey)
+	if err != nil || len(pk) != 32 {
+		return
+	}
+
+	zeros := 0
+	for _, b := range pk[h.offset+1:] {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+
+	ri := pk[h.offset]
+	if value := uint8(zeros + 1); value > h.registers[ri] {
+		h.registers[ri] = value
+	}
+}
+
+// Merge adds the counts of other (which must have the same offset) to h.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, value := range other.registers {
+		if value > h.registers[i] {
+			h.registers[i] = value
+		}
+	}
+}
+
+// Hex returns the registers encoded as they go in the "hll" field of a COUNT response.
+func (h *HyperLogLog) Hex() string {
+	return hex.EncodeToString(h.registers[:])
+}
+
+// countResponse is used instead of nostr.CountEnvelope, which doesn't support the "hll" field
+// (and, as of go-nostr v0.28.1, doesn't encode counts as valid JSON)
+type countResponse struct {
+	SubscriptionID string
+	Count          int64
+	Approximate    bool
+	HLL            *HyperLogLog
+}
+
+func (c countResponse) MarshalJSON() ([]byte, error) {
+	result := struct {
+		Count       int64  `json:"count"`
+		Approximate bool   `json:"approximate,omitempty"`
+		HLL         string `json:"hll,omitempty"`
+	}{Count: c.Count, Approximate: c.Approximate}
+	if c.HLL != nil {
+		result.HLL = c.HLL.Hex()
+	}
+	return json.Marshal([]any{"COUNT", c.SubscriptionID, result})
+}
@@ -0,0 +1,162 @@
+package khatru
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// HandleQuery answers an HTTP GET with the stored events matching a filter given in the query string,
+// like /events?kinds=1,6&authors=<pubkey>&limit=20&%23t=nostr, as a JSON array sorted from newest to oldest.
+// The filter goes through the same policies as a REQ, requests may be authenticated with NIP-98.
+// It's mounted at /events if EnableHTTPQuery is true.
+func (rl *Relay) HandleQuery(w http.ResponseWriter, r *http.Request) {
+	if rl.shedRead() {
+		http.Error(w, errOverloaded.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	filter, err := parseQueryFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := rl.httpContext(r)
+	collector := &eventCollector{events: make([]nostr.Event, 0)}
+	done := make(chan struct{})
+	eose := newEOSECounter(1, func() { close(done) })
+
+	if err := rl.handleRequest(ctx, "", eose, collector, filter, &pinnedEvents{}); err != nil {
+		reason := err.Error()
+		status := http.StatusForbidden
+		if strings.HasPrefix(reason, "auth-required:") {
+			status = http.StatusUnauthorized
+		} else if strings.HasPrefix(reason, "error:") {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, reason, status)
+		return
+	}
+	eose.done()
+
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		return
+	}
+
+	collector.mutex.Lock()
+	events := collector.events
+	collector.mutex.Unlock()
+	slices.SortFunc(events, func(a, b nostr.Event) int { return cmp.Compare(b.CreatedAt, a.CreatedAt) })
+
+	// not all storages respect the limit, so we enforce it here too
+	limit := filter.Limit
+	if rl.MaxLimit > 0 && (limit == 0 || limit > rl.MaxLimit) {
+		limit = rl.MaxLimit
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[0:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// eventCollector gathers the events written by handleRequest, ignoring everything else
+type eventCollector struct {
+	mutex  sync.Mutex
+	events []nostr.Event
+}
+
+func (c *eventCollector) WriteJSON(any any) error {
+	if env, ok := any.(nostr.EventEnvelope); ok {
+		c.mutex.Lock()
+		c.events = append(c.events, env.Event)
+		c.mutex.Unlock()
+	}
+	return nil
+}
+
+// parseQueryFilter builds a filter from query parameters, lists can be comma-separated or repeated
+// and tag queries are given as "#<letter>" (which must be escaped as "%23<letter>" in URLs).
+func parseQueryFilter(query url.Values) (nostr.Filter, error) {
+	filter := nostr.Filter{}
+	list := func(key string) []string {
+		values := make([]string, 0)
+		for _, v := range query[key] {
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					values = append(values, item)
+				}
+			}
+		}
+		return values
+	}
+	timestamp := func(key string) (*nostr.Timestamp, error) {
+		if v := query.Get(key); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			ts := nostr.Timestamp(n)
+			return &ts, nil
+		}
+		return nil, nil
+	}
+
+	for key := range query {
+		switch key {
+		case "ids":
+			filter.IDs = list(key)
+		case "authors":
+			filter.Authors = list(key)
+		case "kinds":
+			for _, v := range list(key) {
+				kind, err := strconv.Atoi(v)
+				if err != nil {
+					return filter, fmt.Errorf("invalid %s: %w", key, err)
+				}
+				filter.Kinds = append(filter.Kinds, kind)
+			}
+		case "since":
+			since, err := timestamp(key)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			filter.Since = since
+		case "until":
+			until, err := timestamp(key)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			filter.Until = until
+		case "limit":
+			limit, err := strconv.Atoi(query.Get(key))
+			if err != nil || limit < 0 {
+				return filter, fmt.Errorf("invalid %s", key)
+			}
+			filter.Limit = limit
+		case "search":
+			filter.Search = query.Get(key)
+		default:
+			if len(key) == 2 && key[0] == '#' {
+				if filter.Tags == nil {
+					filter.Tags = make(nostr.TagMap)
+				}
+				filter.Tags[key[1:]] = list(key)
+			}
+		}
+	}
+
+	return filter, nil
+}
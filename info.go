@@ -0,0 +1,145 @@
+package khatru
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// ValidateInfo normalizes the relay information document (sorting and deduplicating supported_nips)
+// and returns an error if it is malformed. It's called by Start, but if you're using the relay as
+// an http.Handler directly you should call it yourself before serving.
+func (rl *Relay) ValidateInfo() error {
+	if rl.Info == nil {
+		return fmt.Errorf("relay information document is missing")
+	}
+
+	for _, nip := range rl.Info.SupportedNIPs {
+		if nip < 0 {
+			return fmt.Errorf("relay information document has an invalid supported_nips entry: %d", nip)
+		}
+	}
+	slices.Sort(rl.Info.SupportedNIPs)
+	rl.Info.SupportedNIPs = slices.Compact(rl.Info.SupportedNIPs)
+
+	if rl.Info.Software == "" {
+		return fmt.Errorf("relay information document must have a software field")
+	}
+	if rl.Info.PubKey != "" && !nostr.IsValidPublicKeyHex(rl.Info.PubKey) {
+		return fmt.Errorf("relay information document has an invalid pubkey '%s'", rl.Info.PubKey)
+	}
+	if rl.SelfSecretKey != "" && rl.Self != "" {
+		if self, err := nostr.GetPublicKey(rl.SelfSecretKey); err != nil {
+			return fmt.Errorf("relay self secret key is invalid: %w", err)
+		} else if self != rl.Self {
+			return fmt.Errorf("relay self '%s' doesn't match the pubkey of the self secret key '%s'", rl.Self, self)
+		}
+	}
+	if rl.Info.Icon != "" {
+		if u, err := url.Parse(rl.Info.Icon); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("relay information document has an invalid icon url '%s'", rl.Info.Icon)
+		}
+	}
+
+	return nil
+}
+
+// applyLiveConfig fills the parts of the information document that depend on the relay configuration,
+// so they reflect its current state even if it's changed while the relay is running.
+func (rl *Relay) applyLiveConfig(info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+	limitation := nip11.RelayLimitationDocument{}
+	if info.Limitation != nil {
+		limitation = *info.Limitation
+	}
+	if rl.ReadOnly {
+		limitation.RestrictedWrites = true
+	}
+	if rl.MaxSubscriptions > 0 {
+		limitation.MaxSubscriptions = rl.MaxSubscriptions
+	}
+	if rl.MaxLimit > 0 {
+		limitation.MaxLimit = rl.MaxLimit
+	}
+	if rl.MaxMessageSize > 0 {
+		limitation.MaxMessageLength = int(rl.MaxMessageSize)
+	}
+	if rl.MinPOW > 0 {
+		limitation.MinPowDifficulty = rl.MinPOW
+	}
+	if rl.UnauthenticatedGracePeriod > 0 {
+		limitation.AuthRequired = true
+	}
+	limitation.MaxSubidLength = 64
+	info.Limitation = &limitation
+
+	nips := slices.Clone(info.SupportedNIPs)
+	if rl.HandleDeletionsInternally {
+		nips = append(nips, 9)
+	}
+	if rl.MinPOW > 0 || rl.ResolveMinPOW != nil {
+		nips = append(nips, 13)
+	}
+	if rl.EnableNIP40 {
+		nips = append(nips, 40)
+	}
+	if rl.EnableNegentropy {
+		nips = append(nips, 77)
+	}
+	if len(rl.CountEvents) > 0 || len(rl.CountEventsHLL) > 0 {
+		nips = append(nips, 45)
+	}
+	if rl.RejectSearchWhenUnsupported {
+		nips = slices.DeleteFunc(nips, func(nip int) bool { return nip == 50 })
+	}
+	slices.Sort(nips)
+	info.SupportedNIPs = slices.Compact(nips)
+
+	return info
+}
+
+// the rendered document is reused for this long, which takes the load of crawlers away
+// while changes to the configuration still show up quickly
+const nip11CacheTTL = 10 * time.Second
+
+type nip11Cache struct {
+	mutex   sync.Mutex
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// get returns the cached document and its ETag, calling render if it has expired
+func (c *nip11Cache) get(render func() []byte) ([]byte, string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now := time.Now(); now.After(c.expires) {
+		c.body = render()
+		c.etag = nip11ETag(c.body)
+		c.expires = now.Add(nip11CacheTTL)
+	}
+	return c.body, c.etag
+}
+
+func nip11ETag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(hash[0:16]) + `"`
+}
+
+// etagMatches tells if an If-None-Match header includes the given ETag
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
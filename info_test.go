@@ -0,0 +1,39 @@
+package khatru
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSelfMustMatchSelfSecretKey(t *testing.T) {
+	rl, _ := newTestRelay()
+	rl.SelfSecretKey = nostr.GeneratePrivateKey()
+	self, _ := nostr.GetPublicKey(rl.SelfSecretKey)
+
+	rl.Self = self
+	if err := rl.ValidateInfo(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	rl.Self, _ = nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err := rl.ValidateInfo(); err == nil {
+		t.Fatalf("expected a Self that doesn't match the key to be invalid")
+	}
+
+	// and the advertised one is always the one that signed
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/nostr+json")
+	w := httptest.NewRecorder()
+	rl.ServeHTTP(w, req)
+	var doc nip11Document
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("failed to get the NIP-11 document: %d %v", w.Code, err)
+	}
+	if doc.Self != self || doc.SelfSig == "" {
+		t.Fatalf("expected self %s with a signature, got %s", self, doc.Self)
+	}
+}
@@ -3,23 +3,169 @@ package khatru
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/puzpuzpuz/xsync/v3"
 )
 
+// Subscriber is anything that can receive events from subscriptions. WebSocket is the default
+// implementation, but others can be registered with AddSubscriber for non-websocket transports.
+type Subscriber interface {
+	SendEvent(subID string, event *nostr.Event) error
+	SendEOSE(subID string) error
+	SendClosed(subID string, reason string) error
+}
+
 type Listener struct {
 	filters nostr.Filters
 	cancel  context.CancelCauseFunc
+
+	// the context of the REQ that created this subscription, for RejectResponseEvent, once it's canceled
+	// the subscription doesn't get live events anymore
+	ctx context.Context
+
+	// increases with each subscription created, so the oldest can be found
+	seq uint64
+
+	// where live events are delivered
+	sub Subscriber
+	id  string
+
+	// limits the rate of live events, if set
+	throttle *deliveryThrottle
+
+	// unix timestamp of the last time this subscription was created or got a live event
+	lastActive atomic.Int64
+}
+
+var listeners = newListenerRegistry(1)
+
+// SetListenerShards splits the registry of subscriptions into n shards, each subscriber is always kept in
+// the same shard and new events are matched against the shards in parallel, which helps relays with many
+// thousands of subscriptions use more than one core to broadcast. The registry is shared by all relays in
+// the process and this must be called before any of them starts serving, as existing subscriptions are lost.
+func SetListenerShards(n int) {
+	listeners = newListenerRegistry(n)
+}
+
+// listenerShard holds the subscriptions of some subscribers, indexed such that live events
+// are only matched against the ones that can want them
+type listenerShard struct {
+	*xsync.MapOf[Subscriber, *xsync.MapOf[string, *Listener]]
+	index *listenerIndex
+}
+
+// forget is called for each subscription that is removed or replaced
+func (s *listenerShard) forget(listener *Listener) {
+	s.index.remove(listener)
+	if listener.throttle != nil {
+		listener.throttle.stop()
+	}
+}
+
+type listenerRegistry struct {
+	shards []*listenerShard
+}
+
+func newListenerRegistry(n int) *listenerRegistry {
+	if n < 1 {
+		n = 1
+	}
+	r := &listenerRegistry{shards: make([]*listenerShard, n)}
+	for i := range r.shards {
+		r.shards[i] = &listenerShard{
+			MapOf: xsync.NewMapOf[Subscriber, *xsync.MapOf[string, *Listener]](),
+			index: newListenerIndex(),
+		}
+	}
+	return r
 }
 
-var listeners = xsync.NewMapOf[*WebSocket, *xsync.MapOf[string, *Listener]]()
+// shard picks the shard of a subscriber from its address, subscribers that aren't pointers all go to the first
+func (r *listenerRegistry) shard(sub Subscriber) *listenerShard {
+	if len(r.shards) == 1 {
+		return r.shards[0]
+	}
+	if v := reflect.ValueOf(sub); v.Kind() == reflect.Pointer {
+		// addresses are aligned so the low bits are mostly the same, mix them before taking the modulo
+		h := uint64(v.Pointer()) * 0x9e3779b97f4a7c15
+		return r.shards[(h>>32)%uint64(len(r.shards))]
+	}
+	return r.shards[0]
+}
+
+func (r *listenerRegistry) Load(sub Subscriber) (*xsync.MapOf[string, *Listener], bool) {
+	return r.shard(sub).Load(sub)
+}
+
+// LoadAndDelete removes all subscriptions of a subscriber and returns them
+func (r *listenerRegistry) LoadAndDelete(sub Subscriber) (*xsync.MapOf[string, *Listener], bool) {
+	shard := r.shard(sub)
+	subs, ok := shard.LoadAndDelete(sub)
+	if ok {
+		subs.Range(func(_ string, listener *Listener) bool {
+			shard.forget(listener)
+			return true
+		})
+	}
+	return subs, ok
+}
+
+func (r *listenerRegistry) Delete(sub Subscriber) {
+	r.LoadAndDelete(sub)
+}
+
+// deleteIfEmpty forgets a subscriber that has no subscriptions left, atomically with setListener
+func (r *listenerRegistry) deleteIfEmpty(sub Subscriber) {
+	r.shard(sub).Compute(sub, func(subs *xsync.MapOf[string, *Listener], loaded bool) (*xsync.MapOf[string, *Listener], bool) {
+		return subs, !loaded || subs.Size() == 0
+	})
+}
+
+// deleteListener removes a single subscription of a subscriber, it returns false if it didn't exist
+func (r *listenerRegistry) deleteListener(sub Subscriber, subs *xsync.MapOf[string, *Listener], id string) (*Listener, bool) {
+	listener, ok := subs.LoadAndDelete(id)
+	if ok {
+		r.shard(sub).forget(listener)
+	}
+	return listener, ok
+}
+
+func (r *listenerRegistry) Range(f func(sub Subscriber, subs *xsync.MapOf[string, *Listener]) bool) {
+	for _, shard := range r.shards {
+		stop := false
+		shard.Range(func(sub Subscriber, subs *xsync.MapOf[string, *Listener]) bool {
+			if !f(sub, subs) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		if stop {
+			return
+		}
+	}
+}
+
+func (r *listenerRegistry) Size() int {
+	total := 0
+	for _, shard := range r.shards {
+		total += shard.Size()
+	}
+	return total
+}
+
+var listenerSeq atomic.Uint64
 
 func GetListeningFilters() nostr.Filters {
 	respfilters := make(nostr.Filters, 0, listeners.Size()*2)
 
 	// here we go through all the existing listeners
-	listeners.Range(func(_ *WebSocket, subs *xsync.MapOf[string, *Listener]) bool {
+	listeners.Range(func(_ Subscriber, subs *xsync.MapOf[string, *Listener]) bool {
 		subs.Range(func(_ string, listener *Listener) bool {
 			for _, listenerfilter := range listener.filters {
 				for _, respfilter := range respfilters {
@@ -47,41 +193,232 @@ func GetListeningFilters() nostr.Filters {
 	return respfilters
 }
 
-func setListener(id string, ws *WebSocket, filters nostr.Filters, cancel context.CancelCauseFunc) {
-	subs, _ := listeners.LoadOrCompute(ws, func() *xsync.MapOf[string, *Listener] {
-		return xsync.NewMapOf[string, *Listener]()
+// setListener registers the subscription for live events. If placeholder is given it only does that if the
+// placeholder created by reserveListener is still there and ctx wasn't canceled, that is, if the subscription
+// wasn't closed or replaced by another REQ while its stored events were loading, and it returns false otherwise.
+func setListener(ctx context.Context, id string, sub Subscriber, filters nostr.Filters, cancel context.CancelCauseFunc, throttle *deliveryThrottle, placeholder *Listener) bool {
+	listener := &Listener{filters: filters, cancel: cancel, ctx: ctx, seq: listenerSeq.Add(1), sub: sub, id: id, throttle: throttle}
+	listener.lastActive.Store(time.Now().Unix())
+
+	stored := true
+	shard := listeners.shard(sub)
+	shard.Compute(sub, func(subs *xsync.MapOf[string, *Listener], loaded bool) (*xsync.MapOf[string, *Listener], bool) {
+		if !loaded {
+			subs = xsync.NewMapOf[string, *Listener]()
+		}
+		// compared and swapped in a single step, a CLOSE removes the placeholder with a single step too
+		subs.Compute(id, func(current *Listener, exists bool) (*Listener, bool) {
+			if placeholder != nil && (current != placeholder || ctx.Err() != nil) {
+				stored = false
+				return current, !exists
+			}
+			if exists {
+				shard.forget(current)
+			}
+			shard.index.add(listener)
+			return listener, false
+		})
+		return subs, !stored && !loaded
+	})
+
+	if !stored && throttle != nil {
+		throttle.stop()
+	}
+	return stored
+}
+
+// reserveListener makes sure the subscriber has room for the given subscription id, such that it doesn't
+// go over max concurrent subscriptions (ids that already exist don't count as new ones, zero means no limit),
+// it's done atomically so concurrent REQs from the same subscriber can't get past the limit. A placeholder
+// listener that matches nothing is put in place of the subscription, it's replaced by setListener later or must
+// be given to releaseListener if the subscription fails. Until then a CLOSE still reaches the placeholder and
+// cancels the queries of the subscription. If a subscription with that id existed it's returned so the caller
+// can cancel it, it doesn't get live events anymore.
+func reserveListener(id string, sub Subscriber, max int, cancel context.CancelCauseFunc) (placeholder *Listener, previous *Listener, ok bool) {
+	ok = true
+	shard := listeners.shard(sub)
+	shard.Compute(sub, func(subs *xsync.MapOf[string, *Listener], loaded bool) (*xsync.MapOf[string, *Listener], bool) {
+		if !loaded {
+			subs = xsync.NewMapOf[string, *Listener]()
+		}
+		_, exists := subs.Load(id)
+		if !exists && max > 0 && subs.Size() >= max {
+			ok = false
+			return subs, !loaded
+		}
+		placeholder = &Listener{cancel: cancel}
+		placeholder.lastActive.Store(time.Now().Unix())
+		if existing, replaced := subs.LoadAndStore(id, placeholder); replaced {
+			shard.forget(existing)
+			previous = existing
+		}
+		return subs, false
 	})
-	subs.Store(id, &Listener{filters: filters, cancel: cancel})
+	return placeholder, previous, ok
+}
+
+// releaseListener removes a placeholder created by reserveListener, if it wasn't replaced yet
+func releaseListener(id string, sub Subscriber, placeholder *Listener) {
+	if placeholder == nil {
+		return
+	}
+	if subs, ok := listeners.Load(sub); ok {
+		subs.Compute(id, func(current *Listener, loaded bool) (*Listener, bool) {
+			return current, loaded && current == placeholder
+		})
+	}
 }
 
 // remove a specific subscription id from listeners for a given ws client
-// and cancel its specific context
-func removeListenerId(ws *WebSocket, id string) {
-	if subs, ok := listeners.Load(ws); ok {
-		if listener, ok := subs.LoadAndDelete(id); ok {
+// and cancel its specific context. only subscriptions of that same client are
+// looked at, and it returns false if no subscription with that id existed.
+func removeListenerId(sub Subscriber, id string) bool {
+	found := false
+	if subs, ok := listeners.Load(sub); ok {
+		if listener, ok := listeners.deleteListener(sub, subs, id); ok {
 			listener.cancel(fmt.Errorf("subscription closed by client"))
+			found = true
 		}
 		if subs.Size() == 0 {
-			listeners.Delete(ws)
+			listeners.deleteIfEmpty(sub)
 		}
 	}
+	return found
 }
 
 // remove WebSocket conn from listeners
 // (no need to cancel contexts as they are all inherited from the main connection context)
-func removeListener(ws *WebSocket) {
-	listeners.Delete(ws)
+func removeListener(sub Subscriber) {
+	listeners.Delete(sub)
 }
 
-func notifyListeners(event *nostr.Event) {
-	listeners.Range(func(ws *WebSocket, subs *xsync.MapOf[string, *Listener]) bool {
+// notifyListeners sends the event to all matching subscriptions and returns how many got it,
+// if reject isn't nil it's called with the context of each matching subscription to skip it.
+// If oncePerSubscriber is true each subscriber only gets it in its oldest matching subscription.
+// When the registry is sharded each shard is handled in its own goroutine.
+func notifyListeners(event *nostr.Event, reject func(ctx context.Context, event *nostr.Event) bool, oncePerSubscriber bool) int {
+	registry := listeners
+	if len(registry.shards) == 1 {
+		return notifyShard(registry.shards[0], event, reject, oncePerSubscriber)
+	}
+
+	var delivered atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(len(registry.shards))
+	for _, shard := range registry.shards {
+		go func(shard *listenerShard) {
+			defer wg.Done()
+			delivered.Add(int64(notifyShard(shard, event, reject, oncePerSubscriber)))
+		}(shard)
+	}
+	wg.Wait()
+	return int(delivered.Load())
+}
+
+func notifyShard(shard *listenerShard, event *nostr.Event, reject func(ctx context.Context, event *nostr.Event) bool, oncePerSubscriber bool) int {
+	delivered := 0
+	now := time.Now().Unix()
+	var oldest map[Subscriber]*Listener
+	if oncePerSubscriber {
+		oldest = make(map[Subscriber]*Listener)
+	}
+
+	for _, listener := range shard.index.candidates(event) {
+		if listener.ctx != nil && listener.ctx.Err() != nil {
+			// closed while the event was being matched
+			continue
+		}
+		if !listener.filters.Match(event) {
+			continue
+		}
+		if reject != nil && listener.ctx != nil && reject(listener.ctx, event) {
+			continue
+		}
+		if oncePerSubscriber {
+			if current, ok := oldest[listener.sub]; !ok || listener.seq < current.seq {
+				oldest[listener.sub] = listener
+			}
+			continue
+		}
+		if listener.send(event) {
+			listener.lastActive.Store(now)
+			delivered++
+		}
+	}
+	for _, listener := range oldest {
+		if listener.send(event) {
+			listener.lastActive.Store(now)
+			delivered++
+		}
+	}
+	return delivered
+}
+
+// send delivers a live event to the subscription, it returns false if it was dropped by the throttle
+func (listener *Listener) send(event *nostr.Event) bool {
+	if listener.throttle != nil {
+		return listener.throttle.deliver(listener.sub, listener.id, event)
+	}
+	listener.sub.SendEvent(listener.id, event)
+	return true
+}
+
+// closeIdleListeners closes all subscriptions of the given subscriber that had no activity since the given time
+func closeIdleListeners(sub Subscriber, since time.Time) {
+	if subs, ok := listeners.Load(sub); ok {
 		subs.Range(func(id string, listener *Listener) bool {
-			if !listener.filters.Match(event) {
+			if listener.lastActive.Load() >= since.Unix() {
 				return true
 			}
-			ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event})
+			if _, ok := listeners.deleteListener(sub, subs, id); ok {
+				listener.cancel(fmt.Errorf("subscription idle timeout"))
+				sub.SendClosed(id, "error: subscription closed after being idle for too long")
+			}
 			return true
 		})
+		if subs.Size() == 0 {
+			listeners.deleteIfEmpty(sub)
+		}
+	}
+}
+
+// CloseSubscriptionsMatching sends a CLOSED with the given reason to all subscriptions whose filters
+// satisfy the predicate and stops them. It returns the number of subscriptions closed.
+func (rl *Relay) CloseSubscriptionsMatching(predicate func(filters nostr.Filters) bool, reason string) int {
+	reason = nostr.NormalizeOKMessage(reason, "blocked")
+	closed := 0
+	listeners.Range(func(sub Subscriber, subs *xsync.MapOf[string, *Listener]) bool {
+		subs.Range(func(id string, listener *Listener) bool {
+			if !predicate(listener.filters) {
+				return true
+			}
+			if _, ok := listeners.deleteListener(sub, subs, id); ok {
+				listener.cancel(fmt.Errorf("subscription closed by relay"))
+				sub.SendClosed(id, reason)
+				closed++
+			}
+			return true
+		})
+		if subs.Size() == 0 {
+			listeners.deleteIfEmpty(sub)
+		}
 		return true
 	})
+	return closed
+}
+
+// AddSubscriber registers a subscription for live events for a subscriber that isn't a websocket
+// connection, such that the subscription engine can be used in other contexts. New events matching
+// the filters will be delivered through sub.SendEvent until RemoveSubscriber is called.
+func (rl *Relay) AddSubscriber(sub Subscriber, id string, filters nostr.Filters) {
+	setListener(context.Background(), id, sub, filters, func(error) {}, nil, nil)
+}
+
+// RemoveSubscriber removes the given subscription, or all subscriptions for this subscriber if id is empty.
+func (rl *Relay) RemoveSubscriber(sub Subscriber, id string) {
+	if id == "" {
+		removeListener(sub)
+	} else {
+		removeListenerId(sub, id)
+	}
 }
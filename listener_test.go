@@ -0,0 +1,157 @@
+package khatru
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSubscriptionIdsAreScopedToTheConnection(t *testing.T) {
+	rl, _ := newTestRelay()
+	url := serve(t, rl)
+	first := dial(t, url)
+	second := dial(t, url)
+	publisher := dial(t, url)
+
+	first.send("REQ", "a", nostr.Filter{Kinds: []int{1}})
+	first.until("EOSE")
+	second.send("REQ", "a", nostr.Filter{Kinds: []int{1}})
+	second.until("EOSE")
+
+	// each connection has its own "a" in the registry
+	registered := 0
+	rl.clients.Range(func(_ *websocket.Conn, ws *WebSocket) bool {
+		if subs, ok := listeners.Load(ws); ok {
+			if _, ok := subs.Load("a"); ok {
+				registered++
+			}
+		}
+		return true
+	})
+	if registered != 2 {
+		t.Fatalf("expected both connections to have a subscription \"a\", got %d", registered)
+	}
+
+	// replacing it in one connection doesn't touch the other
+	second.send("REQ", "a", nostr.Filter{Kinds: []int{2}})
+	second.until("EOSE")
+	publisher.send("EVENT", mkev(t, 1, "first", nil))
+	publisher.until("OK")
+	if msg, _ := first.until("EVENT"); messageEvent(t, msg).Content != "first" {
+		t.Fatalf("unexpected event %s", msg)
+	}
+	if msg := second.read(100 * time.Millisecond); msg != nil {
+		t.Fatalf("the replaced subscription got %s", msg)
+	}
+
+	// and a CLOSE from one connection doesn't remove the subscription of the other
+	first.send("CLOSE", "a")
+	waitFor(t, "CLOSE", func() bool { return rl.ActiveSubscriptions() == 1 })
+	publisher.send("EVENT", mkev(t, 2, "second", nil))
+	publisher.until("OK")
+	if msg, _ := second.until("EVENT"); messageEvent(t, msg).Content != "second" {
+		t.Fatalf("unexpected event %s", msg)
+	}
+	if msg := first.read(100 * time.Millisecond); msg != nil {
+		t.Fatalf("the closed subscription got %s", msg)
+	}
+}
+
+func TestCloseRacingWithSetListener(t *testing.T) {
+	withListeners(t, 1, 0)
+	sub := &benchSubscriber{n: 1}
+	filters := nostr.Filters{{Kinds: []int{1}}}
+	event := &nostr.Event{Kind: 1, PubKey: benchAuthors[0]}
+
+	for i := 0; i < 2000; i++ {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		placeholder, _, _ := reserveListener("x", sub, 0, cancel)
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			removeListenerId(sub, "x")
+		}()
+		setListener(ctx, "x", sub, filters, cancel, nil, placeholder)
+		<-closed
+
+		// whichever came first, the subscription is gone once both are done
+		if subs, ok := listeners.Load(sub); ok {
+			if _, ok := subs.Load("x"); ok {
+				t.Fatalf("the closed subscription is still registered after %d rounds", i)
+			}
+		}
+		if n := notifyListeners(event, nil, false); n != 0 {
+			t.Fatalf("the closed subscription got a live event after %d rounds", i)
+		}
+	}
+}
+
+// benchSubscriber only counts what it gets, the first field must be distinct for each one as xsync hashes it
+type benchSubscriber struct {
+	n         int64
+	delivered atomic.Int64
+}
+
+func (s *benchSubscriber) SendEvent(subID string, event *nostr.Event) error {
+	s.delivered.Add(1)
+	return nil
+}
+func (s *benchSubscriber) SendEOSE(subID string) error                  { return nil }
+func (s *benchSubscriber) SendClosed(subID string, reason string) error { return nil }
+
+var benchAuthors = func() []string {
+	authors := make([]string, 100)
+	for i := range authors {
+		authors[i] = fmt.Sprintf("%064x", i)
+	}
+	return authors
+}()
+
+// withListeners replaces the global registry for the duration of the test with one of the given number
+// of shards holding n subscriptions, 10 for each subscriber, each one following one of the benchAuthors
+func withListeners(tb testing.TB, shards int, n int) {
+	previous := listeners
+	listeners = newListenerRegistry(shards)
+	tb.Cleanup(func() { listeners = previous })
+
+	for i := 0; i < n/10; i++ {
+		sub := &benchSubscriber{n: int64(i) + 1}
+		for j := 0; j < 10; j++ {
+			filters := nostr.Filters{{Kinds: []int{1}, Authors: []string{benchAuthors[(i*10+j)%len(benchAuthors)]}}}
+			setListener(context.Background(), strconv.Itoa(j), sub, filters, func(error) {}, nil, nil)
+		}
+	}
+}
+
+// BenchmarkBroadcast100kSubscriptions broadcasts to 100k subscriptions from many goroutines, while some
+// of them keep creating and closing subscriptions, with all subscriptions in a single shard or spread over many
+func BenchmarkBroadcast100kSubscriptions(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			withListeners(b, shards, 100_000)
+			event := &nostr.Event{Kind: 1, PubKey: benchAuthors[0], Content: "hello"}
+			var churners atomic.Int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				sub := &benchSubscriber{n: -churners.Add(1)}
+				filters := nostr.Filters{{Kinds: []int{1}, Authors: []string{benchAuthors[1]}}}
+				for i := 0; pb.Next(); i++ {
+					if i%10 == 0 {
+						setListener(context.Background(), "churn", sub, filters, func(error) {}, nil, nil)
+						removeListenerId(sub, "churn")
+						continue
+					}
+					notifyListeners(event, nil, false)
+				}
+			})
+		})
+	}
+}
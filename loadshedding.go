@@ -0,0 +1,47 @@
+package khatru
+
+import (
+	"errors"
+)
+
+var errOverloaded = errors.New("error: relay overloaded, try later")
+
+// LoadShedding makes the relay reject some of its traffic while it's overloaded, so it can keep serving the
+// rest instead of getting slower for everybody. The relay is overloaded while any of the enabled conditions
+// holds, rejected messages get "error: relay overloaded, try later".
+type LoadShedding struct {
+	MaxInFlightQueries int     // queries running at the same time, see InFlightQueries
+	MaxThroughput      float64 // events per second given to AddEvent, accepted or not, see Throughput
+	WhenBreakerOpen    bool    // the CircuitBreaker is open or half-open
+
+	ShedReads  bool // reject new REQs and COUNTs
+	ShedWrites bool // reject EVENTs
+}
+
+// Overloaded tells if any of the LoadShedding conditions holds right now.
+func (rl *Relay) Overloaded() bool {
+	ls := rl.LoadShedding
+	if ls == nil {
+		return false
+	}
+	if ls.MaxInFlightQueries > 0 && rl.queries.Size() >= ls.MaxInFlightQueries {
+		return true
+	}
+	if ls.MaxThroughput > 0 {
+		if accepted, rejected := rl.Throughput(); accepted+rejected >= ls.MaxThroughput {
+			return true
+		}
+	}
+	if ls.WhenBreakerOpen && rl.CircuitBreaker != nil && rl.CircuitBreaker.State() != BreakerClosed {
+		return true
+	}
+	return false
+}
+
+func (rl *Relay) shedRead() bool {
+	return rl.LoadShedding != nil && rl.LoadShedding.ShedReads && rl.Overloaded()
+}
+
+func (rl *Relay) shedWrite() bool {
+	return rl.LoadShedding != nil && rl.LoadShedding.ShedWrites && rl.Overloaded()
+}
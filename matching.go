@@ -0,0 +1,120 @@
+package khatru
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// listenerIndex is an inverted index over the filters of live subscriptions, such that a new event is only
+// matched against the subscriptions that could possibly want it instead of all of them. Each filter is
+// indexed under a single field, the most selective one it has, and the candidates still go through the full
+// filter matching afterwards.
+type listenerIndex struct {
+	mutex   sync.RWMutex
+	buckets map[string]map[*Listener]struct{}
+}
+
+func newListenerIndex() *listenerIndex {
+	return &listenerIndex{buckets: make(map[string]map[*Listener]struct{})}
+}
+
+func (idx *listenerIndex) add(listener *Listener) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	for _, filter := range listener.filters {
+		for _, key := range filterIndexKeys(filter) {
+			bucket, ok := idx.buckets[key]
+			if !ok {
+				bucket = make(map[*Listener]struct{})
+				idx.buckets[key] = bucket
+			}
+			bucket[listener] = struct{}{}
+		}
+	}
+}
+
+func (idx *listenerIndex) remove(listener *Listener) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	for _, filter := range listener.filters {
+		for _, key := range filterIndexKeys(filter) {
+			if bucket, ok := idx.buckets[key]; ok {
+				delete(bucket, listener)
+				if len(bucket) == 0 {
+					delete(idx.buckets, key)
+				}
+			}
+		}
+	}
+}
+
+// candidates returns the listeners with at least one filter indexed under a key the event has
+func (idx *listenerIndex) candidates(event *nostr.Event) []*Listener {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	var res []*Listener
+	seen := make(map[*Listener]struct{})
+	collect := func(key string) {
+		for listener := range idx.buckets[key] {
+			if _, ok := seen[listener]; !ok {
+				seen[listener] = struct{}{}
+				res = append(res, listener)
+			}
+		}
+	}
+
+	collect("*")
+	collect("i:" + event.ID)
+	collect("a:" + event.PubKey)
+	collect("k:" + strconv.Itoa(event.Kind))
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 {
+			collect("#" + tag[0] + ":" + tag[1])
+		}
+	}
+	return res
+}
+
+// filterIndexKeys returns the keys a filter is indexed under, an event matching the filter always has
+// at least one of them: ids are preferred, then authors, then tags and then kinds
+func filterIndexKeys(filter nostr.Filter) []string {
+	if len(filter.IDs) > 0 {
+		return prefixedKeys("i:", filter.IDs)
+	}
+	if len(filter.Authors) > 0 {
+		return prefixedKeys("a:", filter.Authors)
+	}
+	if len(filter.Tags) > 0 {
+		// any tag with values would do, so the same one is always picked
+		names := make([]string, 0, len(filter.Tags))
+		for name, values := range filter.Tags {
+			if len(values) > 0 {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			return prefixedKeys("#"+names[0]+":", filter.Tags[names[0]])
+		}
+	}
+	if len(filter.Kinds) > 0 {
+		keys := make([]string, len(filter.Kinds))
+		for i, kind := range filter.Kinds {
+			keys[i] = "k:" + strconv.Itoa(kind)
+		}
+		return keys
+	}
+	return []string{"*"}
+}
+
+func prefixedKeys(prefix string, values []string) []string {
+	keys := make([]string, len(values))
+	for i, value := range values {
+		keys[i] = prefix + value
+	}
+	return keys
+}
@@ -0,0 +1,98 @@
+package khatru
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// benchListeners are subscriptions like those of a big relay: most follow some authors, some want the mentions
+// of someone and a few want everything of a kind
+func benchListeners(n int) []*Listener {
+	pubkey := func(i int) string { return fmt.Sprintf("%064x", i%5000) }
+	res := make([]*Listener, n)
+	for i := range res {
+		var filter nostr.Filter
+		switch i % 10 {
+		case 0:
+			filter = nostr.Filter{Kinds: []int{i % 50}}
+		case 1, 2:
+			filter = nostr.Filter{Kinds: []int{1, 7}, Tags: nostr.TagMap{"p": []string{pubkey(i)}}}
+		default:
+			filter = nostr.Filter{Kinds: []int{1}, Authors: []string{pubkey(i), pubkey(i + 1), pubkey(i + 2)}}
+		}
+		res[i] = &Listener{filters: nostr.Filters{filter}}
+	}
+	return res
+}
+
+func TestIndexedMatchingFindsTheSameListeners(t *testing.T) {
+	all := benchListeners(5000)
+	index := newListenerIndex()
+	for _, listener := range all {
+		index.add(listener)
+	}
+
+	for i := 0; i < 100; i++ {
+		event := &nostr.Event{Kind: []int{1, 7, 30}[i%3], PubKey: fmt.Sprintf("%064x", i*37), Tags: nostr.Tags{{"p", fmt.Sprintf("%064x", i*11)}}}
+		expected := make(map[*Listener]bool)
+		for _, listener := range all {
+			if listener.filters.Match(event) {
+				expected[listener] = true
+			}
+		}
+		got := 0
+		for _, listener := range index.candidates(event) {
+			if listener.filters.Match(event) {
+				if !expected[listener] {
+					t.Fatalf("the index matched a listener that doesn't want the event")
+				}
+				got++
+			}
+		}
+		if got != len(expected) {
+			t.Fatalf("the index found %d of %d listeners", got, len(expected))
+		}
+	}
+}
+
+// BenchmarkMatching50kSubscriptions matches events against 50k subscriptions by going through all of them
+// and by going only through the candidates from the index
+func BenchmarkMatching50kSubscriptions(b *testing.B) {
+	all := benchListeners(50_000)
+	index := newListenerIndex()
+	for _, listener := range all {
+		index.add(listener)
+	}
+	events := make([]*nostr.Event, 100)
+	for i := range events {
+		events[i] = &nostr.Event{Kind: 1, PubKey: fmt.Sprintf("%064x", i*37), Tags: nostr.Tags{{"p", fmt.Sprintf("%064x", i*11)}}}
+	}
+
+	b.Run("linear", func(b *testing.B) {
+		matched := 0
+		for i := 0; i < b.N; i++ {
+			event := events[i%len(events)]
+			for _, listener := range all {
+				if listener.filters.Match(event) {
+					matched++
+				}
+			}
+		}
+		b.ReportMetric(float64(matched)/float64(b.N), "matches/op")
+	})
+
+	b.Run("indexed", func(b *testing.B) {
+		matched := 0
+		for i := 0; i < b.N; i++ {
+			event := events[i%len(events)]
+			for _, listener := range index.candidates(event) {
+				if listener.filters.Match(event) {
+					matched++
+				}
+			}
+		}
+		b.ReportMetric(float64(matched)/float64(b.N), "matches/op")
+	})
+}
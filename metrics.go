@@ -0,0 +1,86 @@
+package khatru
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Metrics holds counters of what the relay is doing, they are only updated if Relay.Metrics is set.
+// Gauges like the number of open connections are computed when they're read, so they cost nothing otherwise.
+type Metrics struct {
+	EventsReceived atomic.Int64
+	EventsAccepted atomic.Int64
+	EventsRejected atomic.Int64
+
+	ReqMessages   atomic.Int64
+	CountMessages atomic.Int64
+	CloseMessages atomic.Int64
+	AuthMessages  atomic.Int64
+
+	// live events not sent because a subscription was over its DeliveryRateLimit and its buffer was full
+	LiveEventsDropped atomic.Int64
+}
+
+func (rl *Relay) countMessage(envelope nostr.Envelope) {
+	switch envelope.(type) {
+	case *nostr.ReqEnvelope:
+		rl.Metrics.ReqMessages.Add(1)
+	case *nostr.CountEnvelope:
+		rl.Metrics.CountMessages.Add(1)
+	case *nostr.CloseEnvelope:
+		rl.Metrics.CloseMessages.Add(1)
+	case *nostr.AuthEnvelope:
+		rl.Metrics.AuthMessages.Add(1)
+	}
+}
+
+// OpenConnections returns the number of websocket connections currently open.
+func (rl *Relay) OpenConnections() int {
+	return rl.clients.Size()
+}
+
+// ActiveSubscriptions returns the number of subscriptions currently open in all connections.
+func (rl *Relay) ActiveSubscriptions() int {
+	total := 0
+	rl.clients.Range(func(_ *websocket.Conn, ws *WebSocket) bool {
+		if subs, ok := listeners.Load(ws); ok {
+			total += subs.Size()
+		}
+		return true
+	})
+	return total
+}
+
+// HandleMetrics serves the metrics in the Prometheus text format, it isn't mounted anywhere by default
+// so it must be added to the router, like rl.Router().HandleFunc("/metrics", rl.HandleMetrics).
+func (rl *Relay) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	gauge := func(name string, help string, value int) {
+		fmt.Fprintf(w, "# HELP khatru_%s %s\n# TYPE khatru_%s gauge\nkhatru_%s %d\n", name, help, name, name, value)
+	}
+	counter := func(name string, help string, value *atomic.Int64) {
+		fmt.Fprintf(w, "# HELP khatru_%s %s\n# TYPE khatru_%s counter\nkhatru_%s %d\n", name, help, name, name, value.Load())
+	}
+
+	gauge("connections", "Open websocket connections.", rl.OpenConnections())
+	gauge("subscriptions", "Active subscriptions.", rl.ActiveSubscriptions())
+	if rl.CircuitBreaker != nil {
+		gauge("circuit_breaker_state", "Storage circuit breaker state (0 closed, 1 half-open, 2 open).", int(rl.CircuitBreaker.State()))
+	}
+
+	if m := rl.Metrics; m != nil {
+		counter("events_received_total", "Events received from clients.", &m.EventsReceived)
+		counter("events_accepted_total", "Events accepted.", &m.EventsAccepted)
+		counter("events_rejected_total", "Events rejected.", &m.EventsRejected)
+		counter("req_messages_total", "REQ messages received.", &m.ReqMessages)
+		counter("count_messages_total", "COUNT messages received.", &m.CountMessages)
+		counter("close_messages_total", "CLOSE messages received.", &m.CloseMessages)
+		counter("auth_messages_total", "AUTH messages received.", &m.AuthMessages)
+		counter("live_events_dropped_total", "Live events dropped by the delivery rate limit.", &m.LiveEventsDropped)
+	}
+}
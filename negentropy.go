@@ -0,0 +1,461 @@
+package khatru
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NegentropyItem is what NIP-77 set reconciliation needs to know about each stored event
+type NegentropyItem struct {
+	Timestamp nostr.Timestamp
+	ID        string
+}
+
+const (
+	negentropyProtocolVersion = 0x61
+	negentropyBuckets         = 16
+
+	negentropyModeSkip        = 0
+	negentropyModeFingerprint = 1
+	negentropyModeIdList      = 2
+)
+
+const negentropyMaxTimestamp = uint64(math.MaxUint64)
+
+// handleNegentropyMessage handles the NIP-77 NEG-OPEN, NEG-MSG and NEG-CLOSE messages, which go-nostr doesn't parse
+// (and would mistake NEG-CLOSE for a CLOSE). It returns false if the message isn't one of these.
+func (rl *Relay) handleNegentropyMessage(ctx context.Context, ws *WebSocket, message []byte) bool {
+	if !bytes.HasPrefix(bytes.TrimLeft(message, " \t\r\n"), []byte(`["NEG-`)) {
+		return false
+	}
+
+	var msg []json.RawMessage
+	var label, id string
+	if err := json.Unmarshal(message, &msg); err != nil || len(msg) < 2 ||
+		json.Unmarshal(msg[0], &label) != nil || json.Unmarshal(msg[1], &id) != nil {
+		if rl.NoticeOnInvalidMessage {
+			ws.WriteJSON(nostr.NoticeEnvelope("error: could not parse your message"))
+		}
+		return true
+	}
+
+	switch label {
+	case "NEG-OPEN":
+		if !rl.EnableNegentropy || ws.negentropy == nil {
+			ws.WriteJSON([]any{"NEG-ERR", id, "blocked: negentropy is not supported by this relay"})
+			return true
+		}
+
+		var filter nostr.Filter
+		var initial string
+		if len(msg) < 4 || json.Unmarshal(msg[2], &filter) != nil || json.Unmarshal(msg[3], &initial) != nil {
+			ws.WriteJSON([]any{"NEG-ERR", id, "invalid: malformed NEG-OPEN"})
+			return true
+		}
+
+		items, err := rl.negentropyItems(context.WithValue(ctx, subscriptionIdKey, id), filter)
+		if err != nil {
+			ws.WriteJSON([]any{"NEG-ERR", id, err.Error()})
+			return true
+		}
+		session := newNegentropySession(items)
+		ws.negentropy.Store(id, session)
+		rl.reconcileNegentropy(ws, id, session, initial)
+
+	case "NEG-MSG":
+		var query string
+		if len(msg) < 3 || json.Unmarshal(msg[2], &query) != nil {
+			ws.WriteJSON([]any{"NEG-ERR", id, "invalid: malformed NEG-MSG"})
+			return true
+		}
+		if ws.negentropy == nil {
+			return true
+		}
+		session, ok := ws.negentropy.Load(id)
+		if !ok {
+			ws.WriteJSON([]any{"NEG-ERR", id, "closed: no such negentropy session"})
+			return true
+		}
+		rl.reconcileNegentropy(ws, id, session, query)
+
+	case "NEG-CLOSE":
+		if ws.negentropy != nil {
+			ws.negentropy.Delete(id)
+		}
+	}
+
+	return true
+}
+
+// reconcileNegentropy answers a message from the client with a NEG-MSG, or with NEG-ERR if it's invalid
+func (rl *Relay) reconcileNegentropy(ws *WebSocket, id string, session *negentropySession, query string) {
+	q, err := hex.DecodeString(query)
+	if err == nil {
+		var response []byte
+		if response, err = session.reconcile(q); err == nil {
+			ws.WriteJSON([]any{"NEG-MSG", id, hex.EncodeToString(response)})
+			return
+		}
+	}
+	ws.negentropy.Delete(id)
+	ws.WriteJSON([]any{"NEG-ERR", id, "invalid: " + err.Error()})
+}
+
+// negentropyItems gets the items to reconcile for a filter, applying the same restrictions as handleRequest.
+// QueryNegentropyItems is used if it's set, otherwise the events are loaded with QueryEvents.
+func (rl *Relay) negentropyItems(ctx context.Context, filter nostr.Filter) ([]NegentropyItem, error) {
+	if err := rl.checkWriteOnly(ctx); err != nil {
+		return nil, err
+	}
+	for _, ovw := range rl.OverwriteFilter {
+		ovw(ctx, &filter)
+	}
+	for _, reject := range rl.RejectFilter {
+		if reject, msg := reject(ctx, filter); reject {
+			return nil, errors.New(nostr.NormalizeOKMessage(msg, "blocked"))
+		}
+	}
+
+	if rl.QueryNegentropyItems != nil {
+		return rl.QueryNegentropyItems(ctx, filter)
+	}
+
+	items := make([]NegentropyItem, 0)
+	for _, query := range rl.QueryEvents {
+		if !rl.acquireQuerySlot(ctx) {
+			return nil, errors.New("error: relay busy")
+		}
+		ch, err := query(ctx, filter)
+		if err != nil {
+			rl.releaseQuerySlot()
+			return nil, fmt.Errorf(nostr.NormalizeOKMessage(err.Error(), "error"))
+		}
+		for evt := range ch {
+			items = append(items, NegentropyItem{Timestamp: evt.CreatedAt, ID: evt.ID})
+		}
+		rl.releaseQuerySlot()
+	}
+	return items, nil
+}
+
+type negentropyItem struct {
+	timestamp uint64
+	id        [32]byte
+}
+
+// negentropyBound is the exclusive upper bound of a range, ids are given only as long as needed to separate items
+type negentropyBound struct {
+	timestamp uint64
+	prefix    []byte
+}
+
+func (item negentropyItem) before(bound negentropyBound) bool {
+	if item.timestamp != bound.timestamp {
+		return item.timestamp < bound.timestamp
+	}
+	return bytes.Compare(item.id[:], bound.prefix) < 0
+}
+
+// negentropySession holds the items of a NEG-OPEN sorted by timestamp and id, the relay only ever responds
+// to the client (which is the initiator) so it doesn't have to keep anything else between messages.
+type negentropySession struct {
+	items []negentropyItem
+}
+
+func newNegentropySession(items []NegentropyItem) *negentropySession {
+	s := &negentropySession{items: make([]negentropyItem, 0, len(items))}
+	for _, item := range items {
+		var parsed negentropyItem
+		if n, err := hex.Decode(parsed.id[:], []byte(item.ID)); err != nil || n != 32 {
+			continue
+		}
+		parsed.timestamp = uint64(item.Timestamp)
+		s.items = append(s.items, parsed)
+	}
+	slices.SortFunc(s.items, func(a, b negentropyItem) int {
+		if c := cmp.Compare(a.timestamp, b.timestamp); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.id[:], b.id[:])
+	})
+	s.items = slices.CompactFunc(s.items, func(a, b negentropyItem) bool { return a == b })
+	return s
+}
+
+// reconcile processes a negentropy message from the client and returns the response
+func (s *negentropySession) reconcile(query []byte) ([]byte, error) {
+	r := &negentropyReader{buf: query}
+	w := &negentropyWriter{buf: []byte{negentropyProtocolVersion}}
+
+	version, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	if version < 0x60 || version > 0x6f {
+		return nil, errors.New("invalid negentropy protocol version byte")
+	}
+	if version != negentropyProtocolVersion {
+		// tell the client which version we support
+		return w.buf, nil
+	}
+
+	prevBound := negentropyBound{}
+	prevIndex := 0
+	skip := false
+	doSkip := func() {
+		if skip {
+			skip = false
+			w.bound(prevBound)
+			w.varint(negentropyModeSkip)
+		}
+	}
+
+	for len(r.buf) > 0 {
+		currBound, err := r.bound()
+		if err != nil {
+			return nil, err
+		}
+		mode, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+
+		lower := prevIndex
+		upper := s.findLowerBound(prevIndex, currBound)
+
+		switch mode {
+		case negentropyModeSkip:
+			skip = true
+		case negentropyModeFingerprint:
+			theirs, err := r.bytes(16)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Equal(theirs, s.fingerprint(lower, upper)) {
+				skip = true
+			} else {
+				doSkip()
+				s.splitRange(w, lower, upper, currBound)
+			}
+		case negentropyModeIdList:
+			// we aren't the initiator, so we just send all our ids in the range back
+			n, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			if n > uint64(len(r.buf)/32) {
+				return nil, errors.New("negentropy id list is truncated")
+			}
+			r.bytes(int(n) * 32)
+
+			doSkip()
+			s.writeIdList(w, lower, upper, currBound)
+		default:
+			return nil, fmt.Errorf("unexpected negentropy mode %d", mode)
+		}
+
+		prevIndex = upper
+		prevBound = currBound
+	}
+
+	return w.buf, nil
+}
+
+// findLowerBound returns the index of the first item starting at from that isn't before bound
+func (s *negentropySession) findLowerBound(from int, bound negentropyBound) int {
+	return from + sort.Search(len(s.items)-from, func(i int) bool { return !s.items[from+i].before(bound) })
+}
+
+// fingerprint is the first 16 bytes of the sha256 of the sum of the ids (as little-endian 256-bit numbers)
+// followed by the number of items as a varint
+func (s *negentropySession) fingerprint(lower int, upper int) []byte {
+	var sum [32]byte
+	for _, item := range s.items[lower:upper] {
+		var carry uint16
+		for i := 0; i < 32; i++ {
+			carry += uint16(sum[i]) + uint16(item.id[i])
+			sum[i] = byte(carry)
+			carry >>= 8
+		}
+	}
+
+	w := &negentropyWriter{buf: sum[:]}
+	w.varint(uint64(upper - lower))
+	hash := sha256.Sum256(w.buf)
+	return hash[0:16]
+}
+
+// splitRange sends a range that didn't match either as a list of ids, if small, or as fingerprints of sub-ranges
+func (s *negentropySession) splitRange(w *negentropyWriter, lower int, upper int, upperBound negentropyBound) {
+	total := upper - lower
+	if total < negentropyBuckets*2 {
+		s.writeIdList(w, lower, upper, upperBound)
+		return
+	}
+
+	perBucket := total / negentropyBuckets
+	withExtra := total % negentropyBuckets
+	curr := lower
+	for i := 0; i < negentropyBuckets; i++ {
+		size := perBucket
+		if i < withExtra {
+			size++
+		}
+		fingerprint := s.fingerprint(curr, curr+size)
+		curr += size
+
+		next := upperBound
+		if curr != upper {
+			next = minimalBound(s.items[curr-1], s.items[curr])
+		}
+		w.bound(next)
+		w.varint(negentropyModeFingerprint)
+		w.buf = append(w.buf, fingerprint...)
+	}
+}
+
+func (s *negentropySession) writeIdList(w *negentropyWriter, lower int, upper int, upperBound negentropyBound) {
+	w.bound(upperBound)
+	w.varint(negentropyModeIdList)
+	w.varint(uint64(upper - lower))
+	for _, item := range s.items[lower:upper] {
+		w.buf = append(w.buf, item.id[:]...)
+	}
+}
+
+// minimalBound returns the shortest bound that separates prev from curr
+func minimalBound(prev negentropyItem, curr negentropyItem) negentropyBound {
+	if curr.timestamp != prev.timestamp {
+		return negentropyBound{timestamp: curr.timestamp}
+	}
+	shared := 0
+	for shared < 32 && curr.id[shared] == prev.id[shared] {
+		shared++
+	}
+	return negentropyBound{timestamp: curr.timestamp, prefix: curr.id[0 : shared+1]}
+}
+
+// negentropyReader decodes a message, timestamps are encoded as differences from the previous one
+type negentropyReader struct {
+	buf           []byte
+	lastTimestamp uint64
+}
+
+var errNegentropyTruncated = errors.New("negentropy message is truncated")
+
+func (r *negentropyReader) byte() (byte, error) {
+	if len(r.buf) == 0 {
+		return 0, errNegentropyTruncated
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b, nil
+}
+
+func (r *negentropyReader) bytes(n int) ([]byte, error) {
+	if len(r.buf) < n {
+		return nil, errNegentropyTruncated
+	}
+	b := r.buf[0:n]
+	r.buf = r.buf[n:]
+	return b, nil
+}
+
+// varint reads a base-128 number with the most significant group first
+func (r *negentropyReader) varint() (uint64, error) {
+	var n uint64
+	for i := 0; i < 10; i++ {
+		b, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		n = (n << 7) | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return n, nil
+		}
+	}
+	return 0, errors.New("negentropy varint is too long")
+}
+
+func (r *negentropyReader) timestamp() (uint64, error) {
+	n, err := r.varint()
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := negentropyMaxTimestamp
+	if n != 0 {
+		timestamp = n - 1
+	}
+	if r.lastTimestamp == negentropyMaxTimestamp || timestamp == negentropyMaxTimestamp {
+		r.lastTimestamp = negentropyMaxTimestamp
+		return negentropyMaxTimestamp, nil
+	}
+	timestamp += r.lastTimestamp
+	r.lastTimestamp = timestamp
+	return timestamp, nil
+}
+
+func (r *negentropyReader) bound() (negentropyBound, error) {
+	timestamp, err := r.timestamp()
+	if err != nil {
+		return negentropyBound{}, err
+	}
+	size, err := r.varint()
+	if err != nil {
+		return negentropyBound{}, err
+	}
+	if size > 32 {
+		return negentropyBound{}, errors.New("negentropy bound is too long")
+	}
+	prefix, err := r.bytes(int(size))
+	if err != nil {
+		return negentropyBound{}, err
+	}
+	return negentropyBound{timestamp: timestamp, prefix: prefix}, nil
+}
+
+// negentropyWriter encodes a message in the same way negentropyReader decodes it
+type negentropyWriter struct {
+	buf           []byte
+	lastTimestamp uint64
+}
+
+func (w *negentropyWriter) varint(n uint64) {
+	var tmp [10]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(n & 0x7f)
+	for n >>= 7; n > 0; n >>= 7 {
+		i--
+		tmp[i] = byte(n&0x7f) | 0x80
+	}
+	w.buf = append(w.buf, tmp[i:]...)
+}
+
+func (w *negentropyWriter) timestamp(timestamp uint64) {
+	if timestamp == negentropyMaxTimestamp {
+		w.lastTimestamp = negentropyMaxTimestamp
+		w.varint(0)
+		return
+	}
+	delta := timestamp - w.lastTimestamp
+	w.lastTimestamp = timestamp
+	w.varint(delta + 1)
+}
+
+func (w *negentropyWriter) bound(bound negentropyBound) {
+	w.timestamp(bound.timestamp)
+	w.varint(uint64(len(bound.prefix)))
+	w.buf = append(w.buf, bound.prefix...)
+}
@@ -0,0 +1,47 @@
+package khatru
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// validateNIP98 checks the "Authorization: Nostr <base64 event>" header of an HTTP request
+// according to NIP-98 and returns the pubkey that signed it.
+func (rl *Relay) validateNIP98(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Nostr ") {
+		return "", errors.New("missing nostr authorization header")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[6:]))
+	if err != nil {
+		return "", errors.New("authorization header is not valid base64")
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(b, &evt); err != nil {
+		return "", errors.New("authorization event is malformed")
+	}
+
+	if evt.Kind != 27235 {
+		return "", errors.New("authorization event has the wrong kind")
+	}
+	if delta := nostr.Now() - evt.CreatedAt; delta > 60 || delta < -60 {
+		return "", errors.New("authorization event is too old or too new")
+	}
+	if u := evt.Tags.GetFirst([]string{"u", ""}); u == nil || u.Value() != rl.ServiceURL+r.URL.RequestURI() {
+		return "", errors.New("authorization event is for a different url")
+	}
+	if m := evt.Tags.GetFirst([]string{"method", ""}); m == nil || !strings.EqualFold(m.Value(), r.Method) {
+		return "", errors.New("authorization event is for a different method")
+	}
+	if ok, err := evt.CheckSignature(); err != nil || !ok {
+		return "", errors.New("authorization event signature is invalid")
+	}
+
+	return evt.PubKey, nil
+}
@@ -0,0 +1,63 @@
+package khatru
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/sebest/xff"
+)
+
+// outgoingLimiter keeps track of the bytes that are waiting to be written to all connections
+// and evicts the slowest connection whenever the total goes over MaxTotalOutgoingBytes.
+type outgoingLimiter struct {
+	rl       *Relay
+	total    atomic.Int64
+	evicting atomic.Bool
+}
+
+func (ol *outgoingLimiter) queued(ws *WebSocket, n int) {
+	ws.pendingBytes.Add(int64(n))
+	if ol.total.Add(int64(n)) > int64(ol.rl.MaxTotalOutgoingBytes) && ol.evicting.CompareAndSwap(false, true) {
+		go func() {
+			defer ol.evicting.Store(false)
+			ol.evictSlowest()
+		}()
+	}
+}
+
+func (ol *outgoingLimiter) sent(ws *WebSocket, n int) {
+	ws.pendingBytes.Add(-int64(n))
+	ol.total.Add(-int64(n))
+}
+
+// evictSlowest closes the connection with the largest amount of data waiting to be written
+func (ol *outgoingLimiter) evictSlowest() {
+	var slowest *WebSocket
+	var most int64
+	ol.rl.clients.Range(func(_ *websocket.Conn, ws *WebSocket) bool {
+		if pending := ws.pendingBytes.Load(); pending > most {
+			slowest = ws
+			most = pending
+		}
+		return true
+	})
+	if slowest == nil {
+		return
+	}
+
+	ol.rl.Log.Printf("evicting slow client %s with %d bytes pending\n", xff.GetRemoteAddr(slowest.Request), most)
+	slowest.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"),
+		time.Now().Add(ol.rl.WriteWait))
+	slowest.conn.Close()
+}
+
+// OutgoingBytes returns the total amount of bytes currently waiting to be written to all connections.
+// It's only tracked when MaxTotalOutgoingBytes is set.
+func (rl *Relay) OutgoingBytes() int64 {
+	if rl.outgoing == nil {
+		return 0
+	}
+	return rl.outgoing.total.Load()
+}
@@ -0,0 +1,104 @@
+package policies
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// BlockContentSubstrings returns a function that can be used as a RejectEvent that will reject events whose
+// content contains any of the given substrings. Use NewContentBlocklist instead to be able to change the
+// patterns later or to also look at tag values.
+func BlockContentSubstrings(patterns []string, caseInsensitive bool) func(context.Context, *nostr.Event) (bool, string) {
+	return NewContentBlocklist(patterns, caseInsensitive).RejectEvent
+}
+
+// ContentBlocklist rejects events whose content contains one of its patterns. The patterns can be replaced
+// at any time with SetPatterns, for example from a management API, while the relay is running.
+type ContentBlocklist struct {
+	// if set the values of all tags are checked too, not only the content (set it before the blocklist is used)
+	IncludeTags bool
+
+	mu              sync.RWMutex
+	caseInsensitive bool
+	useRegexp       bool
+	patterns        []string
+	compiled        []*regexp.Regexp
+}
+
+// NewContentBlocklist creates a blocklist in which the patterns are plain substrings.
+func NewContentBlocklist(patterns []string, caseInsensitive bool) *ContentBlocklist {
+	b := &ContentBlocklist{caseInsensitive: caseInsensitive}
+	b.SetPatterns(patterns)
+	return b
+}
+
+// NewContentBlocklistRegexp creates a blocklist in which the patterns are regular expressions, it fails if
+// one of them doesn't compile.
+func NewContentBlocklistRegexp(patterns []string, caseInsensitive bool) (*ContentBlocklist, error) {
+	b := &ContentBlocklist{caseInsensitive: caseInsensitive, useRegexp: true}
+	if err := b.SetPatterns(patterns); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetPatterns replaces all the patterns of the blocklist. If it's a regular expression blocklist and one
+// of them doesn't compile the previous patterns are kept and the error is returned.
+func (b *ContentBlocklist) SetPatterns(patterns []string) error {
+	compiled := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		if !b.useRegexp {
+			pattern = regexp.QuoteMeta(pattern)
+		}
+		if b.caseInsensitive {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		compiled[i] = re
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.patterns = slices.Clone(patterns)
+	b.compiled = compiled
+	return nil
+}
+
+// Patterns returns the patterns currently in the blocklist.
+func (b *ContentBlocklist) Patterns() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return slices.Clone(b.patterns)
+}
+
+// RejectEvent can be used as a RejectEvent.
+func (b *ContentBlocklist) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, re := range b.compiled {
+		if re.MatchString(event.Content) {
+			return true, "blocked: content not allowed"
+		}
+		if b.IncludeTags {
+			for _, tag := range event.Tags {
+				if len(tag) < 2 {
+					continue
+				}
+				for _, value := range tag[1:] {
+					if re.MatchString(value) {
+						return true, "blocked: content not allowed"
+					}
+				}
+			}
+		}
+	}
+	return false, ""
+}
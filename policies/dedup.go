@@ -0,0 +1,92 @@
+package policies
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// RejectDuplicateContent returns a function that can be used as a RejectDuplicateContent that will reject
+// events from an author whose normalized content was already seen from the same author within the given window.
+func RejectDuplicateContent(window time.Duration) func(context.Context, *nostr.Event) (bool, string) {
+	seen := NewWindowedSet(window)
+
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		normalized := NormalizeContent(event.Content)
+		if normalized == "" {
+			return false, ""
+		}
+
+		if !seen.Add(ContentHash(event.PubKey, normalized)) {
+			return true, khatru.StructuredReason("rate-limited", "duplicate content", map[string]string{
+				khatru.ReasonFieldRetryAfter: strconv.Itoa(int(window.Seconds())),
+			})
+		}
+		return false, ""
+	}
+}
+
+// NormalizeContent lowercases the content and strips everything that isn't a letter or a number,
+// such that tiny variations in punctuation, casing and spacing end up producing the same string.
+func NormalizeContent(content string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, content)
+}
+
+// ContentHash returns a hex-encoded hash of the given content scoped to the given author.
+func ContentHash(pubkey string, normalizedContent string) string {
+	hash := sha256.Sum256([]byte(pubkey + ":" + normalizedContent))
+	return hex.EncodeToString(hash[:])
+}
+
+// WindowedSet is a set of strings in which each item is only kept for a fixed amount of time.
+type WindowedSet struct {
+	mu        sync.Mutex
+	window    time.Duration
+	items     map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewWindowedSet(window time.Duration) *WindowedSet {
+	return &WindowedSet{
+		window:    window,
+		items:     make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Add inserts the key in the set and returns false if it was already there (and not yet expired).
+func (s *WindowedSet) Add(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	// get rid of expired items once in a while so the set doesn't grow forever
+	if now.Sub(s.lastSweep) > s.window {
+		for k, added := range s.items {
+			if now.Sub(added) > s.window {
+				delete(s.items, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if added, exists := s.items[key]; exists && now.Sub(added) <= s.window {
+		return false
+	}
+	s.items[key] = now
+	return true
+}
@@ -2,6 +2,9 @@ package policies
 
 import (
 	"context"
+	"strconv"
+	"strings"
+	"time"
 
 	"slices"
 
@@ -46,6 +49,17 @@ func PreventTooManyIndexableTags(max int, ignoreKinds []int, onlyKinds []int) fu
 	}
 }
 
+// RestrictTagCountPerKind returns a function that can be used as a RejectEvent that will reject
+// events with more tags than the limit specified for their kind. Kinds not in the map are not restricted.
+func RestrictTagCountPerKind(maxTagsPerKind map[int]int) func(context.Context, *nostr.Event) (bool, string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if max, ok := maxTagsPerKind[event.Kind]; ok && len(event.Tags) > max {
+			return true, "invalid: too many tags for this kind"
+		}
+		return false, ""
+	}
+}
+
 // PreventLargeTags rejects events that have indexable tag values greater than maxTagValueLen.
 func PreventLargeTags(maxTagValueLen int) func(context.Context, *nostr.Event) (bool, string) {
 	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
@@ -60,6 +74,21 @@ func PreventLargeTags(maxTagValueLen int) func(context.Context, *nostr.Event) (b
 	}
 }
 
+// RestrictTagValueLength returns a function that can be used as a RejectEvent that will reject events
+// with any tag value longer than maxLen. Unlike PreventLargeTags all tags and all their values are checked.
+func RestrictTagValueLength(maxLen int) func(context.Context, *nostr.Event) (bool, string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		for _, tag := range event.Tags {
+			for i := 1; i < len(tag); i++ {
+				if len(tag[i]) > maxLen {
+					return true, "invalid: tag value too long"
+				}
+			}
+		}
+		return false, ""
+	}
+}
+
 // RestrictToSpecifiedKinds returns a function that can be used as a RejectFilter that will reject
 // any events with kinds different than the specified ones.
 func RestrictToSpecifiedKinds(kinds ...uint16) func(context.Context, *nostr.Event) (bool, string) {
@@ -92,6 +121,38 @@ func RestrictToSpecifiedKinds(kinds ...uint16) func(context.Context, *nostr.Even
 	}
 }
 
+// KindRange is an inclusive range of event kinds.
+type KindRange struct {
+	Min int
+	Max int
+}
+
+// DefaultKnownKindRanges are the ranges defined by NIP-01: regular, replaceable, ephemeral and
+// parameterized replaceable events. Everything above these is unassigned.
+var DefaultKnownKindRanges = []KindRange{
+	{0, 9999},
+	{10000, 19999},
+	{20000, 29999},
+	{30000, 39999},
+}
+
+// RestrictToKnownKindRanges returns a function that can be used as a RejectEvent that will reject
+// events whose kind is not inside any of the given ranges. If no ranges are given DefaultKnownKindRanges is used.
+func RestrictToKnownKindRanges(ranges ...KindRange) func(context.Context, *nostr.Event) (bool, string) {
+	if len(ranges) == 0 {
+		ranges = DefaultKnownKindRanges
+	}
+
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		for _, r := range ranges {
+			if r.Min <= event.Kind && event.Kind <= r.Max {
+				return false, ""
+			}
+		}
+		return true, "unsupported: unknown event kind"
+	}
+}
+
 func PreventTimestampsInThePast(thresholdSeconds nostr.Timestamp) func(context.Context, *nostr.Event) (bool, string) {
 	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
 		if nostr.Now()-event.CreatedAt > thresholdSeconds {
@@ -109,3 +170,85 @@ func PreventTimestampsInTheFuture(thresholdSeconds nostr.Timestamp) func(context
 		return false, ""
 	}
 }
+
+// RequireAuthorAge returns a function that can be used as a RejectEvent that will reject events from authors
+// first seen less than minAge ago, as freshly created keys are often used for spam. firstSeen must return when
+// the given pubkey was first seen, usually the time of its oldest event in the storage, and false if it was never
+// seen, in which case it's treated as just created.
+func RequireAuthorAge(minAge time.Duration, firstSeen func(pubkey string) (time.Time, bool)) func(context.Context, *nostr.Event) (bool, string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		var age time.Duration
+		if seen, ok := firstSeen(event.PubKey); ok {
+			age = time.Since(seen)
+		}
+		if age < minAge {
+			return true, "restricted: account too new"
+		}
+		return false, ""
+	}
+}
+
+// RequireReferencedAddressesExist returns a function that can be used as a RejectEvent that will reject
+// events that reference addressable or replaceable events (in "a" tags) that can't be found using the given
+// query function.
+//
+// If strict is true all referenced coordinates must exist, otherwise finding any one of them is enough.
+func RequireReferencedAddressesExist(
+	query func(context.Context, nostr.Filter) (chan *nostr.Event, error),
+	strict bool,
+) func(context.Context, *nostr.Event) (bool, string) {
+	exists := func(ctx context.Context, coordinate string) bool {
+		spl := strings.SplitN(coordinate, ":", 3)
+		if len(spl) != 3 {
+			return false
+		}
+		kind, err := strconv.Atoi(spl[0])
+		if err != nil || !nostr.IsValidPublicKeyHex(spl[1]) {
+			return false
+		}
+
+		filter := nostr.Filter{Kinds: []int{kind}, Authors: []string{spl[1]}, Limit: 1}
+		if 30000 <= kind && kind < 40000 {
+			// other replaceable events are referenced with an empty d and don't have the tag
+			filter.Tags = nostr.TagMap{"d": []string{spl[2]}}
+		}
+
+		qctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		ch, err := query(qctx, filter)
+		if err != nil {
+			return false
+		}
+		found := <-ch != nil
+		// whatever else comes is discarded, without waiting for storages that don't stop when canceled
+		go func() {
+			for range ch {
+			}
+		}()
+		return found
+	}
+
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		referenced := 0
+		found := 0
+		for _, tag := range event.Tags {
+			if len(tag) < 2 || tag[0] != "a" {
+				continue
+			}
+			referenced++
+			if exists(ctx, tag[1]) {
+				found++
+				if !strict {
+					return false, ""
+				}
+			} else if strict {
+				return true, "referenced article not found"
+			}
+		}
+
+		if referenced > 0 && found == 0 {
+			return true, "referenced article not found"
+		}
+		return false, ""
+	}
+}
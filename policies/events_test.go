@@ -0,0 +1,106 @@
+package policies
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func tags(name string, n int) nostr.Tags {
+	res := make(nostr.Tags, n)
+	for i := range res {
+		res[i] = nostr.Tag{name, nostr.GeneratePrivateKey()}
+	}
+	return res
+}
+
+func TestRestrictTagCountPerKind(t *testing.T) {
+	reject := RestrictTagCountPerKind(map[int]int{1: 10, 3: 1000})
+
+	for _, tc := range []struct {
+		kind   int
+		tags   int
+		reject bool
+	}{
+		{1, 10, false},
+		{1, 11, true},
+		{3, 11, false},
+		{3, 1000, false},
+		{3, 1001, true},
+		{7, 5000, false},
+	} {
+		rejected, msg := reject(context.Background(), &nostr.Event{Kind: tc.kind, Tags: tags("p", tc.tags)})
+		if rejected != tc.reject {
+			t.Fatalf("kind %d with %d tags: expected reject=%v, got %v", tc.kind, tc.tags, tc.reject, rejected)
+		}
+		if rejected && msg != "invalid: too many tags for this kind" {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	}
+}
+
+func TestRestrictTagValueLength(t *testing.T) {
+	reject := RestrictTagValueLength(100)
+	long := strings.Repeat("A", 101)
+
+	for _, tc := range []struct {
+		tags   nostr.Tags
+		reject bool
+	}{
+		{nostr.Tags{{"t", strings.Repeat("a", 100)}}, false},
+		{nostr.Tags{{"t", long}}, true},
+		{nostr.Tags{{"e", nostr.GeneratePrivateKey(), long}}, true},
+		{nostr.Tags{{"p", nostr.GeneratePrivateKey()}, {"imeta", "url https://x", "blurhash " + long}}, true},
+		{nostr.Tags{{long}}, false}, // only values are checked
+	} {
+		rejected, msg := reject(context.Background(), &nostr.Event{Kind: 1, Tags: tc.tags})
+		if rejected != tc.reject {
+			t.Fatalf("%v: expected reject=%v", tc.tags, tc.reject)
+		}
+		if rejected && msg != "invalid: tag value too long" {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	}
+}
+
+func TestRequireReferencedAddressesExist(t *testing.T) {
+	relay := testRelay()
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+	pk, _ := nostr.GetPublicKey(sk)
+	relay.AddEvent(ctx, signed(t, sk, 10002, nostr.Tags{{"r", "wss://example.com"}}))
+	relay.AddEvent(ctx, signed(t, sk, 30023, nostr.Tags{{"d", "article"}}))
+
+	// a storage that sends everything and doesn't stop when the context is canceled
+	all := func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+			results, _ := relay.QueryEvents[0](ctx, filter)
+			for evt := range results {
+				ch <- evt
+				ch <- evt
+			}
+		}()
+		return ch, nil
+	}
+	reject := RequireReferencedAddressesExist(all, true)
+
+	for _, tc := range []struct {
+		coordinate string
+		reject     bool
+	}{
+		{"10002:" + pk + ":", false},
+		{"30023:" + pk + ":article", false},
+		{"30023:" + pk + ":", true},
+		{"30023:" + pk + ":other", true},
+		{"10000:" + pk + ":", true},
+		{"30023:nothex:article", true},
+	} {
+		if rejected, _ := reject(ctx, signed(t, sk, 1, nostr.Tags{{"a", tc.coordinate}})); rejected != tc.reject {
+			t.Fatalf("%s: expected reject %v, got %v", tc.coordinate, tc.reject, rejected)
+		}
+	}
+}
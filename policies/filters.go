@@ -2,9 +2,11 @@ package policies
 
 import (
 	"context"
+	"time"
 
 	"slices"
 
+	"github.com/fiatjaf/khatru"
 	"github.com/nbd-wtf/go-nostr"
 )
 
@@ -83,3 +85,78 @@ func RemoveAllButTags(tagNames ...string) func(context.Context, *nostr.Filter) {
 		}
 	}
 }
+
+// RestrictAnonymousToRecent makes it so clients that aren't authenticated can only see events created
+// within the given window, by moving the since of their filters forward. It only ever narrows the filter,
+// so it can be combined with other OverwriteFilter policies in any order.
+func RestrictAnonymousToRecent(window time.Duration) func(context.Context, *nostr.Filter) {
+	return func(ctx context.Context, filter *nostr.Filter) {
+		if khatru.GetAuthed(ctx) != "" {
+			return
+		}
+
+		since := nostr.Timestamp(Now().Add(-window).Unix())
+		if filter.Until != nil && *filter.Until < since {
+			filter.Limit = -1 // signals that this query should be just skipped
+			return
+		}
+		if filter.Since == nil || *filter.Since < since {
+			filter.Since = &since
+		}
+	}
+}
+
+// RequireAuthForReads returns a function that can be used as a RejectFilter that rejects all filters from
+// clients that aren't authenticated with "auth-required:", but first it sends them an AUTH challenge and
+// waits up to timeout for them to authenticate (no waiting happens if timeout is zero).
+func RequireAuthForReads(timeout time.Duration) func(context.Context, nostr.Filter) (bool, string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		if khatru.GetAuthed(ctx) != "" {
+			return false, ""
+		}
+		if timeout > 0 && khatru.WaitForAuth(ctx, timeout) != "" {
+			return false, ""
+		}
+		return true, "auth-required: you must authenticate to read from this relay"
+	}
+}
+
+// RestrictFilterListSizes returns a function that can be used as a RejectFilter or RejectCountFilter that
+// rejects filters with more than the given number of ids, authors or values for any single tag.
+// Zero means no limit for that list.
+func RestrictFilterListSizes(maxIDs, maxAuthors, maxTagValues int) func(context.Context, nostr.Filter) (bool, string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		if maxIDs > 0 && len(filter.IDs) > maxIDs {
+			return true, "too many ids in filter"
+		}
+		if maxAuthors > 0 && len(filter.Authors) > maxAuthors {
+			return true, "too many authors in filter"
+		}
+		if maxTagValues > 0 {
+			for _, values := range filter.Tags {
+				if len(values) > maxTagValues {
+					return true, "too many tag values in filter"
+				}
+			}
+		}
+		return false, ""
+	}
+}
+
+// RestrictTagQueryValueCount returns a function that can be used as a RejectFilter or RejectCountFilter that
+// rejects filters with more values for a tag than the limit given for its letter, like {"p": 100}. Tags that are
+// not in the map are not restricted, the "*" key can be used to set a limit for all of them.
+func RestrictTagQueryValueCount(maxValuesPerTag map[string]int) func(context.Context, nostr.Filter) (bool, string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		for name, values := range filter.Tags {
+			max, ok := maxValuesPerTag[name]
+			if !ok {
+				max, ok = maxValuesPerTag["*"]
+			}
+			if ok && len(values) > max {
+				return true, "invalid: too many values in #" + name + " filter"
+			}
+		}
+		return false, ""
+	}
+}
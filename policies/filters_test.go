@@ -0,0 +1,47 @@
+package policies
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func pubkeys(n int) []string {
+	res := make([]string, n)
+	for i := range res {
+		res[i] = nostr.GeneratePrivateKey()
+	}
+	return res
+}
+
+func TestRestrictTagQueryValueCount(t *testing.T) {
+	reject := RestrictTagQueryValueCount(map[string]int{"p": 100, "*": 10})
+
+	for _, tc := range []struct {
+		tags nostr.TagMap
+		msg  string
+	}{
+		{nostr.TagMap{"p": pubkeys(100)}, ""},
+		{nostr.TagMap{"p": pubkeys(101)}, "invalid: too many values in #p filter"},
+		{nostr.TagMap{"p": pubkeys(5000)}, "invalid: too many values in #p filter"},
+		{nostr.TagMap{"e": pubkeys(10)}, ""},
+		{nostr.TagMap{"e": pubkeys(11)}, "invalid: too many values in #e filter"},
+		{nostr.TagMap{"p": pubkeys(50), "t": pubkeys(20)}, "invalid: too many values in #t filter"},
+		{nil, ""},
+	} {
+		rejected, msg := reject(context.Background(), nostr.Filter{Tags: tc.tags})
+		if rejected != (tc.msg != "") || msg != tc.msg {
+			t.Fatalf("expected %q, got %v %q", tc.msg, rejected, msg)
+		}
+	}
+
+	// without a "*" other tags are not restricted
+	onlyP := RestrictTagQueryValueCount(map[string]int{"p": 1})
+	if rejected, _ := onlyP(context.Background(), nostr.Filter{Tags: nostr.TagMap{"e": pubkeys(1000)}}); rejected {
+		t.Fatalf("a tag without a limit was restricted")
+	}
+	if rejected, _ := onlyP(context.Background(), nostr.Filter{Tags: nostr.TagMap{"p": pubkeys(2)}}); !rejected {
+		t.Fatalf("an oversized #p filter was accepted")
+	}
+}
@@ -17,17 +17,17 @@ func RejectKind04Snoopers(ctx context.Context, filter nostr.Filter) (bool, strin
 		return false, ""
 	}
 
-	ws := khatru.GetConnection(ctx)
+	authed := khatru.GetAuthed(ctx)
 	senders := filter.Authors
 	receivers, _ := filter.Tags["p"]
 	switch {
-	case ws.AuthedPublicKey == "":
+	case authed == "":
 		// not authenticated
 		return true, "restricted: this relay does not serve kind-4 to unauthenticated users, does your client implement NIP-42?"
-	case len(senders) == 1 && len(receivers) < 2 && (senders[0] == ws.AuthedPublicKey):
+	case len(senders) == 1 && len(receivers) < 2 && (senders[0] == authed):
 		// allowed filter: ws.authed is sole sender (filter specifies one or all receivers)
 		return false, ""
-	case len(receivers) == 1 && len(senders) < 2 && (receivers[0] == ws.AuthedPublicKey):
+	case len(receivers) == 1 && len(senders) < 2 && (receivers[0] == authed):
 		// allowed filter: ws.authed is sole receiver (filter specifies one or all senders)
 		return false, ""
 	default:
@@ -0,0 +1,68 @@
+package policies
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// how long a NIP-05 verification result is remembered by RequireNIP05
+const nip05CacheTTL = 10 * time.Minute
+
+// RequireNIP05 returns a function that can be used as a RejectEvent that will reject events from authors that
+// don't have a valid NIP-05 identifier in one of the given domains.
+//
+// verify must return the NIP-05 identifier ("name@domain") of the given pubkey and whether it is valid, it is
+// up to the caller to do the .well-known lookup. Results are cached for a while so verify isn't called for every event.
+func RequireNIP05(domains []string, verify func(pubkey string) (string, bool)) func(context.Context, *nostr.Event) (bool, string) {
+	type result struct {
+		ok      bool
+		checked time.Time
+	}
+	// domains are case-insensitive, identifiers are lowercased before they're compared too
+	lowered := make([]string, len(domains))
+	for i, domain := range domains {
+		lowered[i] = strings.ToLower(domain)
+	}
+	mu := sync.Mutex{}
+	cache := make(map[string]result)
+	lastSweep := time.Now()
+
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		mu.Lock()
+		res, cached := cache[event.PubKey]
+		mu.Unlock()
+
+		if !cached || time.Since(res.checked) > nip05CacheTTL {
+			identifier, valid := verify(event.PubKey)
+			res = result{checked: time.Now()}
+			if valid {
+				if spl := strings.Split(identifier, "@"); len(spl) == 2 {
+					res.ok = slices.Contains(lowered, strings.ToLower(spl[1]))
+				}
+			}
+
+			mu.Lock()
+			if time.Since(lastSweep) > nip05CacheTTL {
+				for pubkey, r := range cache {
+					if time.Since(r.checked) > nip05CacheTTL {
+						delete(cache, pubkey)
+					}
+				}
+				lastSweep = time.Now()
+			}
+			cache[event.PubKey] = res
+			mu.Unlock()
+		}
+
+		if !res.ok {
+			return true, "restricted: NIP-05 verification required"
+		}
+		return false, ""
+	}
+}
@@ -0,0 +1,28 @@
+package policies
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRequireNIP05IgnoresCase(t *testing.T) {
+	identifiers := map[string]string{}
+	reject := RequireNIP05([]string{"Example.COM"}, func(pubkey string) (string, bool) {
+		return identifiers[pubkey], true
+	})
+
+	for identifier, allowed := range map[string]bool{
+		"bob@example.com":  true,
+		"bob@EXAMPLE.com":  true,
+		"bob@example.org":  false,
+		"bob@Example.COM2": false,
+	} {
+		pubkey := nostr.GeneratePrivateKey()
+		identifiers[pubkey] = identifier
+		if rejected, _ := reject(context.Background(), &nostr.Event{PubKey: pubkey}); rejected == allowed {
+			t.Fatalf("%s: expected allowed=%v", identifier, allowed)
+		}
+	}
+}
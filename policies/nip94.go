@@ -0,0 +1,51 @@
+package policies
+
+import (
+	"context"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DefaultFileMetadataTags are the tags ValidateFileMetadata requires when none are given.
+var DefaultFileMetadataTags = []string{"url", "m", "x", "size"}
+
+// ValidateFileMetadata returns a function that can be used as a RejectEvent that will reject NIP-94 file
+// metadata events (kind 1063) that don't have all the required tags, or DefaultFileMetadataTags if none
+// are given. Other kinds are not checked.
+//
+// If checkValues is true the "x" tag must also be a hex-encoded sha256 and "size" a number of bytes,
+// when they're present.
+func ValidateFileMetadata(checkValues bool, requiredTags ...string) func(context.Context, *nostr.Event) (bool, string) {
+	if len(requiredTags) == 0 {
+		requiredTags = DefaultFileMetadataTags
+	}
+
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if event.Kind != 1063 {
+			return false, ""
+		}
+
+		for _, name := range requiredTags {
+			if tag := event.Tags.GetFirst([]string{name, ""}); tag == nil || (*tag).Value() == "" {
+				return true, "invalid: file metadata missing required tags"
+			}
+		}
+
+		if checkValues {
+			if tag := event.Tags.GetFirst([]string{"x", ""}); tag != nil {
+				if b, err := hex.DecodeString((*tag).Value()); err != nil || len(b) != 32 {
+					return true, "invalid: file metadata hash must be a hex-encoded sha256"
+				}
+			}
+			if tag := event.Tags.GetFirst([]string{"size", ""}); tag != nil {
+				if _, err := strconv.ParseUint((*tag).Value(), 10, 64); err != nil {
+					return true, "invalid: file metadata size must be a number of bytes"
+				}
+			}
+		}
+
+		return false, ""
+	}
+}
@@ -0,0 +1,57 @@
+package policies
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestValidateFileMetadata(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	valid := nostr.Tags{{"url", "https://example.com/a.png"}, {"m", "image/png"}, {"x", hash}, {"size", "1024"}}
+	without := func(name string) nostr.Tags {
+		var res nostr.Tags
+		for _, tag := range valid {
+			if tag[0] != name {
+				res = append(res, tag)
+			}
+		}
+		return res
+	}
+	with := func(name string, value ...string) nostr.Tags {
+		return append(without(name), append(nostr.Tag{name}, value...))
+	}
+
+	const missing = "invalid: file metadata missing required tags"
+	for _, tc := range []struct {
+		reject func(context.Context, *nostr.Event) (bool, string)
+		kind   int
+		tags   nostr.Tags
+		msg    string
+	}{
+		{ValidateFileMetadata(false), 1063, valid, ""},
+		{ValidateFileMetadata(false), 1063, nil, missing},
+		{ValidateFileMetadata(false), 1063, without("url"), missing},
+		{ValidateFileMetadata(false), 1063, without("m"), missing},
+		{ValidateFileMetadata(false), 1063, without("x"), missing},
+		{ValidateFileMetadata(false), 1063, without("size"), missing},
+		{ValidateFileMetadata(false), 1063, with("url", ""), missing},
+		{ValidateFileMetadata(false), 1063, with("url"), missing},
+		{ValidateFileMetadata(false), 1063, with("x", "not a hash"), ""},
+		{ValidateFileMetadata(true), 1063, with("x", "not a hash"), "invalid: file metadata hash must be a hex-encoded sha256"},
+		{ValidateFileMetadata(true), 1063, with("x", hash[2:]), "invalid: file metadata hash must be a hex-encoded sha256"},
+		{ValidateFileMetadata(true), 1063, with("size", "-1"), "invalid: file metadata size must be a number of bytes"},
+		{ValidateFileMetadata(true), 1063, with("size", "1kb"), "invalid: file metadata size must be a number of bytes"},
+		{ValidateFileMetadata(true), 1063, valid, ""},
+		{ValidateFileMetadata(false, "url"), 1063, nostr.Tags{{"url", "https://example.com/a.png"}}, ""},
+		{ValidateFileMetadata(false, "url", "dim"), 1063, valid, missing},
+		{ValidateFileMetadata(true), 1, nil, ""},
+	} {
+		rejected, msg := tc.reject(context.Background(), &nostr.Event{Kind: tc.kind, Tags: tc.tags})
+		if rejected != (tc.msg != "") || msg != tc.msg {
+			t.Fatalf("kind %d with %v: expected %q, got %v %q", tc.kind, tc.tags, tc.msg, rejected, msg)
+		}
+	}
+}
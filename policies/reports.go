@@ -0,0 +1,39 @@
+package policies
+
+import (
+	"context"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// HideReportedEvents returns a function that can be used as an OnReport that will delete from storage
+// every event referenced by a report once it has been reported by at least threshold different pubkeys
+// other than its author, see khatru.Relay.CountReports.
+func HideReportedEvents(relay *khatru.Relay, threshold int64) func(context.Context, *nostr.Event) {
+	return func(ctx context.Context, report *nostr.Event) {
+		for _, tag := range report.Tags {
+			if len(tag) < 2 || tag[0] != "e" {
+				continue
+			}
+
+			for _, query := range relay.QueryEvents {
+				ch, err := query(ctx, nostr.Filter{IDs: []string{tag[1]}})
+				if err != nil {
+					continue
+				}
+				target := <-ch
+				for range ch {
+					// drained, so the storage isn't stuck trying to send to us
+				}
+				if target == nil {
+					continue
+				}
+				if relay.CountReports(ctx, target) >= threshold {
+					relay.RemoveEvent(ctx, target)
+				}
+				break
+			}
+		}
+	}
+}
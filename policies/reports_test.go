@@ -0,0 +1,85 @@
+package policies
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// testRelay returns a relay that keeps its events in memory
+func testRelay() *khatru.Relay {
+	var mutex sync.Mutex
+	var events []*nostr.Event
+
+	relay := khatru.NewRelay()
+	relay.StoreEvent = append(relay.StoreEvent, func(ctx context.Context, evt *nostr.Event) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, evt)
+		return nil
+	})
+	relay.DeleteEvent = append(relay.DeleteEvent, func(ctx context.Context, evt *nostr.Event) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for i, stored := range events {
+			if stored.ID == evt.ID {
+				events = append(events[:i], events[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+	relay.QueryEvents = append(relay.QueryEvents, func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		ch := make(chan *nostr.Event, len(events))
+		for _, evt := range events {
+			if filter.Matches(evt) {
+				ch <- evt
+			}
+		}
+		close(ch)
+		return ch, nil
+	})
+	return relay
+}
+
+func signed(t *testing.T, sk string, kind int, tags nostr.Tags) *nostr.Event {
+	t.Helper()
+	evt := &nostr.Event{Kind: kind, Tags: tags, CreatedAt: nostr.Now()}
+	if err := evt.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return evt
+}
+
+func TestHideReportedEvents(t *testing.T) {
+	relay := testRelay()
+	relay.OnReport = append(relay.OnReport, HideReportedEvents(relay, 2))
+	ctx := context.Background()
+
+	target := signed(t, nostr.GeneratePrivateKey(), 1, nil)
+	if err := relay.AddEvent(ctx, target); err != nil {
+		t.Fatal(err)
+	}
+	stored := func() bool {
+		ch, _ := relay.QueryEvents[0](ctx, nostr.Filter{IDs: []string{target.ID}})
+		return <-ch != nil
+	}
+
+	reporter := nostr.GeneratePrivateKey()
+	for i := 0; i < 3; i++ {
+		relay.AddEvent(ctx, signed(t, reporter, 1984, nostr.Tags{{"e", target.ID, "spam"}, {"n", strconv.Itoa(i)}}))
+	}
+	if !stored() {
+		t.Fatalf("the event was hidden after reports by a single pubkey")
+	}
+	relay.AddEvent(ctx, signed(t, nostr.GeneratePrivateKey(), 1984, nostr.Tags{{"e", target.ID, "spam"}}))
+	if stored() {
+		t.Fatalf("the event wasn't hidden after two reports")
+	}
+}
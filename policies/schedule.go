@@ -0,0 +1,63 @@
+package policies
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Now is the clock used by the time-dependent policies, it can be replaced to control time in tests.
+var Now = time.Now
+
+// TimeWindow is a daily period between Start and End, both given as offsets from midnight, in Location
+// (or UTC if nil). If Start is after End the window spans midnight. If Weekdays is set the window only
+// opens on those days (the day in which it starts, for windows that span midnight).
+type TimeWindow struct {
+	Start    time.Duration
+	End      time.Duration
+	Weekdays []time.Weekday
+	Location *time.Location
+}
+
+// Contains tells if the given time falls inside the window.
+func (tw TimeWindow) Contains(t time.Time) bool {
+	loc := tw.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	offset := t.Sub(midnight)
+
+	openedOn := func(day time.Weekday) bool {
+		return len(tw.Weekdays) == 0 || slices.Contains(tw.Weekdays, day)
+	}
+
+	if tw.Start <= tw.End {
+		return openedOn(t.Weekday()) && offset >= tw.Start && offset < tw.End
+	}
+	if offset >= tw.Start {
+		return openedOn(t.Weekday())
+	}
+	return offset < tw.End && openedOn(midnight.AddDate(0, 0, -1).Weekday())
+}
+
+// AcceptKindDuringWindow returns a function that can be used as a RejectEvent that only accepts events of the
+// given kind while the current time is inside at least one of the windows. Other kinds are not affected.
+func AcceptKindDuringWindow(kind int, schedule ...TimeWindow) func(context.Context, *nostr.Event) (bool, string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if event.Kind != kind {
+			return false, ""
+		}
+
+		now := Now()
+		for _, window := range schedule {
+			if window.Contains(now) {
+				return false, ""
+			}
+		}
+		return true, "restricted: submissions are currently closed"
+	}
+}
@@ -0,0 +1,64 @@
+package policies
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// setNow makes Now return the given time until the test ends
+func setNow(t *testing.T, now *time.Time) {
+	previous := Now
+	Now = func() time.Time { return *now }
+	t.Cleanup(func() { Now = previous })
+}
+
+func TestAcceptKindDuringWindow(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+
+	var now time.Time
+	setNow(t, &now)
+	reject := AcceptKindDuringWindow(1, TimeWindow{
+		Start:    9 * time.Hour,
+		End:      17 * time.Hour,
+		Weekdays: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		Location: berlin,
+	}, TimeWindow{
+		// saturday night to sunday morning
+		Start:    22 * time.Hour,
+		End:      2 * time.Hour,
+		Weekdays: []time.Weekday{time.Saturday},
+	})
+
+	for _, tc := range []struct {
+		now    time.Time
+		kind   int
+		accept bool
+	}{
+		{time.Date(2024, 3, 4, 9, 0, 0, 0, berlin), 1, true},      // monday at opening
+		{time.Date(2024, 3, 4, 16, 59, 0, 0, berlin), 1, true},    // monday before closing
+		{time.Date(2024, 3, 4, 17, 0, 0, 0, berlin), 1, false},    // monday at closing
+		{time.Date(2024, 3, 4, 8, 0, 0, 0, time.UTC), 1, true},    // 9h in berlin
+		{time.Date(2024, 3, 4, 16, 30, 0, 0, time.UTC), 1, false}, // 17h30 in berlin
+		{time.Date(2024, 3, 5, 3, 0, 0, 0, berlin), 7, true},      // other kinds are always accepted
+		{time.Date(2024, 3, 9, 12, 0, 0, 0, berlin), 1, false},    // saturday
+		{time.Date(2024, 3, 9, 23, 0, 0, 0, time.UTC), 1, true},   // saturday night
+		{time.Date(2024, 3, 10, 1, 0, 0, 0, time.UTC), 1, true},   // still saturday night
+		{time.Date(2024, 3, 10, 2, 0, 0, 0, time.UTC), 1, false},
+		{time.Date(2024, 3, 10, 23, 0, 0, 0, time.UTC), 1, false}, // sunday night
+	} {
+		now = tc.now
+		rejected, msg := reject(context.Background(), &nostr.Event{Kind: tc.kind})
+		if rejected == tc.accept {
+			t.Fatalf("kind %d at %s: expected accept=%v", tc.kind, tc.now, tc.accept)
+		}
+		if rejected && msg != "restricted: submissions are currently closed" {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package policies
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ScoreRejection returns a function that can be used as a SpamScorer that gives weight to the events
+// the given policy would reject, such that any RejectEvent policy can be used as a weak signal instead
+// of a final decision.
+func ScoreRejection(weight float64, policy func(context.Context, *nostr.Event) (bool, string)) func(context.Context, *nostr.Event) float64 {
+	return func(ctx context.Context, event *nostr.Event) float64 {
+		if reject, _ := policy(ctx, event); reject {
+			return weight
+		}
+		return 0
+	}
+}
+
+// ScoreLinks returns a function that can be used as a SpamScorer that gives weightPerLink for each
+// http or https link in the content of the event.
+func ScoreLinks(weightPerLink float64) func(context.Context, *nostr.Event) float64 {
+	return func(ctx context.Context, event *nostr.Event) float64 {
+		links := strings.Count(event.Content, "http://") + strings.Count(event.Content, "https://")
+		return float64(links) * weightPerLink
+	}
+}
+
+// ScoreMentions returns a function that can be used as a SpamScorer that gives weightPerMention for each
+// "p" tag after the first free ones, as mass-mentioning is a common way of spamming.
+func ScoreMentions(free int, weightPerMention float64) func(context.Context, *nostr.Event) float64 {
+	return func(ctx context.Context, event *nostr.Event) float64 {
+		mentions := 0
+		for _, tag := range event.Tags {
+			if len(tag) >= 2 && tag[0] == "p" {
+				mentions++
+			}
+		}
+		if mentions <= free {
+			return 0
+		}
+		return float64(mentions-free) * weightPerMention
+	}
+}
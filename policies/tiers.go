@@ -0,0 +1,53 @@
+package policies
+
+import (
+	"context"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// EventPolicyByTier returns a function that can be used as a RejectEvent that runs the policy for the tier of
+// the connection (see khatru.ResolveConnectionTier), or fallback for tiers not in the map. A nil policy accepts everything.
+func EventPolicyByTier(
+	policies map[khatru.Tier]func(context.Context, *nostr.Event) (bool, string),
+	fallback func(context.Context, *nostr.Event) (bool, string),
+) func(context.Context, *nostr.Event) (bool, string) {
+	return func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		policy, ok := policies[khatru.GetTier(ctx)]
+		if !ok {
+			policy = fallback
+		}
+		if policy == nil {
+			return false, ""
+		}
+		return policy(ctx, event)
+	}
+}
+
+// FilterPolicyByTier is like EventPolicyByTier, but for RejectFilter.
+func FilterPolicyByTier(
+	policies map[khatru.Tier]func(context.Context, nostr.Filter) (bool, string),
+	fallback func(context.Context, nostr.Filter) (bool, string),
+) func(context.Context, nostr.Filter) (bool, string) {
+	return func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+		policy, ok := policies[khatru.GetTier(ctx)]
+		if !ok {
+			policy = fallback
+		}
+		if policy == nil {
+			return false, ""
+		}
+		return policy(ctx, filter)
+	}
+}
+
+// RestrictKindsByTier returns a function that can be used as a RejectEvent that only accepts the kinds
+// listed for the tier of the connection. Tiers that are not in the map can publish anything.
+func RestrictKindsByTier(kinds map[khatru.Tier][]uint16) func(context.Context, *nostr.Event) (bool, string) {
+	policies := make(map[khatru.Tier]func(context.Context, *nostr.Event) (bool, string), len(kinds))
+	for tier, allowed := range kinds {
+		policies[tier] = RestrictToSpecifiedKinds(allowed...)
+	}
+	return EventPolicyByTier(policies, nil)
+}
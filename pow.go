@@ -0,0 +1,37 @@
+package khatru
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+)
+
+// minPOW returns the NIP-13 difficulty required for events in this context
+func (rl *Relay) minPOW(ctx context.Context) int {
+	if rl.ResolveMinPOW != nil {
+		return rl.ResolveMinPOW(ctx)
+	}
+	return rl.MinPOW
+}
+
+// checkPOW returns an error if the event id doesn't have at least difficulty leading zero bits or if
+// its "nonce" tag doesn't commit to a target at least as high, as a high difficulty reached by chance
+// doesn't count as proof of work.
+func checkPOW(evt *nostr.Event, difficulty int) error {
+	if nip13.Difficulty(evt.ID) < difficulty {
+		return RejectPoW(fmt.Sprintf("difficulty %d required", difficulty))
+	}
+
+	nonce := evt.Tags.GetFirst([]string{"nonce", ""})
+	if nonce == nil || len(*nonce) < 3 {
+		return RejectPoW(fmt.Sprintf("difficulty %d required", difficulty))
+	}
+	if target, err := strconv.Atoi((*nonce)[2]); err != nil || target < difficulty {
+		return RejectPoW(fmt.Sprintf("difficulty %d required", difficulty))
+	}
+
+	return nil
+}
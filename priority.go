@@ -0,0 +1,44 @@
+package khatru
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// priorityBuffer holds the stored events of a REQ until EOSE so they can be sent ordered by DeliveryPriority.
+// Other messages are written immediately.
+type priorityBuffer struct {
+	w        jsonWriter
+	priority map[int]int
+
+	mutex  sync.Mutex
+	events []nostr.EventEnvelope
+}
+
+func (b *priorityBuffer) WriteJSON(any any) error {
+	if env, ok := any.(nostr.EventEnvelope); ok {
+		b.mutex.Lock()
+		b.events = append(b.events, env)
+		b.mutex.Unlock()
+		return nil
+	}
+	return b.w.WriteJSON(any)
+}
+
+// flush sends the buffered events, higher priorities first and otherwise in the order they were loaded
+func (b *priorityBuffer) flush() {
+	b.mutex.Lock()
+	events := b.events
+	b.events = nil
+	b.mutex.Unlock()
+
+	slices.SortStableFunc(events, func(x, y nostr.EventEnvelope) int {
+		return cmp.Compare(b.priority[y.Event.Kind], b.priority[x.Event.Kind])
+	})
+	for _, env := range events {
+		b.w.WriteJSON(env)
+	}
+}
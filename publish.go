@@ -0,0 +1,44 @@
+package khatru
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// HandlePublish accepts a JSON event in the body of an HTTP POST and runs it through the same path as
+// an EVENT message received from a websocket, responding with the resulting OK message as JSON.
+// Requests may be authenticated with NIP-98, in which case GetAuthed will return the signer's pubkey.
+// It's mounted at /event if EnableHTTPPublish is true.
+func (rl *Relay) HandlePublish(w http.ResponseWriter, r *http.Request) {
+	var evt nostr.Event
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, rl.MaxMessageSize)).Decode(&evt); err != nil {
+		http.Error(w, "invalid event", http.StatusBadRequest)
+		return
+	}
+
+	ctx := rl.httpContext(r)
+	result := nostr.OKEnvelope{EventID: evt.ID, OK: true}
+	if err := rl.handleEvent(ctx, &evt); err != nil {
+		result.Reason = err.Error()
+		result.OK = HasReasonPrefix(result.Reason, PrefixDuplicate)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// httpContext returns a context for handling HTTP requests with a connection that has no websocket, just so
+// policies can call GetConnection, GetIP and GetAuthed. Requests authenticated with NIP-98 are considered authed.
+func (rl *Relay) httpContext(r *http.Request) context.Context {
+	ws := &WebSocket{Request: r}
+	if rl.ResolveConnectionTier != nil {
+		ws.Tier = rl.ResolveConnectionTier(r)
+	}
+	if pubkey, err := rl.validateNIP98(r); err == nil {
+		ws.AuthedPublicKey = pubkey
+	}
+	return context.WithValue(r.Context(), wsKey, ws)
+}
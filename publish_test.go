@@ -0,0 +1,62 @@
+package khatru
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestPoliciesCanAskForAuthOverHTTP(t *testing.T) {
+	rl, _ := newTestRelay()
+	rl.EnableHTTPPublish = true
+	rl.EnableHTTPQuery = true
+	// these are fine on websockets, and must do nothing over HTTP
+	askForAuth := func(ctx context.Context) {
+		RequestAuth(ctx)
+		ws := GetConnection(ctx)
+		if ws.Authed != nil {
+			t.Errorf("RequestAuth is waiting for an AUTH that can't happen")
+		}
+		if err := ws.WriteJSON(nostr.NoticeEnvelope("hello")); err != errNoConnection {
+			t.Errorf("expected the write to fail, got %v", err)
+		}
+	}
+	rl.RejectEvent = append(rl.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		askForAuth(ctx)
+		return false, ""
+	})
+	rl.RejectFilter = append(rl.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		askForAuth(ctx)
+		return false, ""
+	})
+	server := httptest.NewServer(rl)
+	defer server.Close()
+
+	body, _ := json.Marshal(mkev(t, 1, "hello", nil))
+	resp, err := http.Post(server.URL+"/event", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to publish: %s", err)
+	}
+	var ok nostr.OKEnvelope
+	json.NewDecoder(resp.Body).Decode(&ok)
+	resp.Body.Close()
+	if !ok.OK {
+		t.Fatalf("expected the event to be accepted, got %v", ok)
+	}
+
+	resp, err = http.Get(server.URL + "/events?kinds=1")
+	if err != nil {
+		t.Fatalf("failed to query: %s", err)
+	}
+	var events []nostr.Event
+	json.NewDecoder(resp.Body).Decode(&events)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(events) != 1 {
+		t.Fatalf("expected the event to be returned, got %d %v", resp.StatusCode, events)
+	}
+}
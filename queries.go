@@ -0,0 +1,106 @@
+package khatru
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// QueryOrder is the order in which a query is expected to return events, see GetQueryOrder
+type QueryOrder int
+
+const (
+	OrderNewestFirst QueryOrder = iota // the NIP-01 default, which decides which events a limit keeps
+	OrderOldestFirst
+)
+
+// DefaultQueryOrder is used when ResolveQueryOrder isn't set. Filters are answered newest first, except
+// when they have a "since" but no "until" or "limit": then all events after "since" are returned anyway,
+// so the storage can go forward from it.
+func DefaultQueryOrder(filter nostr.Filter) QueryOrder {
+	if filter.Since != nil && filter.Until == nil && filter.Limit == 0 {
+		return OrderOldestFirst
+	}
+	return OrderNewestFirst
+}
+
+// QueryInfo describes a QueryEvents call that is still running, see Relay.InFlightQueries
+type QueryInfo struct {
+	ID             string
+	SubscriptionID string
+	IP             string
+	Filter         nostr.Filter
+	Started        time.Time
+	Elapsed        time.Duration
+}
+
+type inflightQuery struct {
+	info   QueryInfo
+	cancel context.CancelFunc
+}
+
+// trackQuery registers a query that is about to run and returns the context it should run with, which
+// carries the order hint and is canceled by CancelQuery or after QueryTimeout, and a function that must be
+// called once it's finished.
+func (rl *Relay) trackQuery(ctx context.Context, subscriptionId string, filter nostr.Filter) (context.Context, func()) {
+	order := DefaultQueryOrder(filter)
+	if rl.ResolveQueryOrder != nil {
+		order = rl.ResolveQueryOrder(ctx, filter)
+	}
+	qctx, cancel := rl.withQueryTimeout(context.WithValue(ctx, queryOrderKey, order))
+	q := &inflightQuery{
+		info: QueryInfo{
+			ID:             strconv.FormatInt(rl.queryIds.Add(1), 10),
+			SubscriptionID: subscriptionId,
+			Filter:         filter,
+			Started:        time.Now(),
+		},
+		cancel: cancel,
+	}
+	if ws, ok := ctx.Value(wsKey).(*WebSocket); ok && ws.Request != nil {
+		q.info.IP = GetIP(ctx)
+	}
+
+	rl.queries.Store(q.info.ID, q)
+	return qctx, func() {
+		rl.queries.Delete(q.info.ID)
+		cancel()
+	}
+}
+
+// withQueryTimeout returns a context for a single query, which is canceled after QueryTimeout if it's set
+func (rl *Relay) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if rl.QueryTimeout > 0 {
+		return context.WithTimeout(ctx, rl.QueryTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// InFlightQueries returns the QueryEvents calls that are running right now, from the oldest to the newest.
+func (rl *Relay) InFlightQueries() []QueryInfo {
+	now := time.Now()
+	res := make([]QueryInfo, 0, rl.queries.Size())
+	rl.queries.Range(func(_ string, q *inflightQuery) bool {
+		info := q.info
+		info.Elapsed = now.Sub(info.Started)
+		res = append(res, info)
+		return true
+	})
+	slices.SortFunc(res, func(a, b QueryInfo) int { return a.Started.Compare(b.Started) })
+	return res
+}
+
+// CancelQuery cancels the context of a query returned by InFlightQueries, so storages that respect it stop
+// early. No more events from it are sent to the client, but the subscription and the connection are kept.
+// It returns false if there is no such query (for example, because it has already finished).
+func (rl *Relay) CancelQuery(id string) bool {
+	q, ok := rl.queries.LoadAndDelete(id)
+	if !ok {
+		return false
+	}
+	q.cancel()
+	return true
+}
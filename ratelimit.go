@@ -0,0 +1,88 @@
+package khatru
+
+import (
+	"sync"
+	"time"
+)
+
+// windowCounter counts hits per key inside fixed time windows, all counts are reset
+// together when a window ends so it never grows beyond the keys seen in one window.
+type windowCounter struct {
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+func newWindowCounter() *windowCounter {
+	return &windowCounter{start: time.Now(), counts: make(map[string]int)}
+}
+
+// hit increments the counter for the given key and returns the new count within the current window.
+func (wc *windowCounter) hit(key string, window time.Duration) int {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if now := time.Now(); now.Sub(wc.start) > window {
+		wc.start = now
+		wc.counts = make(map[string]int, len(wc.counts))
+	}
+	wc.counts[key]++
+	return wc.counts[key]
+}
+
+// IPRateLimiter is a token bucket per IP: each IP can do Burst actions at once and then Rate actions
+// per second. Buckets that were idle for long enough to be full again are forgotten.
+type IPRateLimiter struct {
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Allow takes one token from the bucket of the given IP and tells if there was one available.
+func (l *IPRateLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+		l.lastSweep = now
+	}
+
+	// a bucket refills completely after this long, so there is no point in keeping it
+	idle := time.Hour
+	if l.Rate > 0 {
+		idle = time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	}
+	if now.Sub(l.lastSweep) > idle {
+		for key, bucket := range l.buckets {
+			if now.Sub(bucket.last) > idle {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[ip] = bucket
+	} else {
+		bucket.tokens = min(float64(l.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.Rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
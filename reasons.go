@@ -0,0 +1,106 @@
+package khatru
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Rejection is an error with a machine-readable prefix, like the ones NIP-01 defines for OK and CLOSED
+// messages. When it's returned by a StoreEvent function it's preserved as is in the OK message instead
+// of being normalized with the "error:" prefix, and AddEvent returns it such that it can be checked with errors.As.
+type Rejection struct {
+	Prefix  string
+	Message string
+}
+
+func (r *Rejection) Error() string { return Reason(r.Prefix, r.Message) }
+
+// the machine-readable prefixes NIP-01 and NIP-42 define for OK and CLOSED messages
+const (
+	PrefixDuplicate    = "duplicate"
+	PrefixPoW          = "pow"
+	PrefixBlocked      = "blocked"
+	PrefixRateLimited  = "rate-limited"
+	PrefixInvalid      = "invalid"
+	PrefixRestricted   = "restricted"
+	PrefixError        = "error"
+	PrefixAuthRequired = "auth-required"
+	PrefixUnsupported  = "unsupported"
+)
+
+// Reason builds a reason for OK and CLOSED messages, like "blocked: you are banned".
+func Reason(prefix string, message string) string { return prefix + ": " + message }
+
+// HasReasonPrefix tells if a reason from an OK or CLOSED message has the given prefix.
+func HasReasonPrefix(reason string, prefix string) bool { return strings.HasPrefix(reason, prefix+":") }
+
+func RejectBlocked(msg string) error      { return &Rejection{PrefixBlocked, msg} }
+func RejectRateLimited(msg string) error  { return &Rejection{PrefixRateLimited, msg} }
+func RejectInvalid(msg string) error      { return &Rejection{PrefixInvalid, msg} }
+func RejectRestricted(msg string) error   { return &Rejection{PrefixRestricted, msg} }
+func RejectAuthRequired(msg string) error { return &Rejection{PrefixAuthRequired, msg} }
+func RejectPoW(msg string) error          { return &Rejection{PrefixPoW, msg} }
+
+// well-known fields for StructuredReason
+const (
+	ReasonFieldRetryAfter = "retry_after" // seconds after which the client may try again
+	ReasonFieldDoc        = "doc"         // URL of a page explaining the rejection
+)
+
+// StructuredReason builds a reason for OK and CLOSED messages with machine-parseable fields appended to
+// the human-readable message, like "rate-limited: too fast|retry_after=5|doc=https://example.com/limits".
+// Fields are sorted by key and their values are query-escaped, so they can't contain a "|" themselves.
+// Clients that don't know about the convention will still see a normal prefixed message.
+func StructuredReason(prefix string, message string, fields map[string]string) string {
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString(": ")
+	b.WriteString(strings.ReplaceAll(message, "|", " "))
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		b.WriteString("|")
+		b.WriteString(url.QueryEscape(k))
+		b.WriteString("=")
+		b.WriteString(url.QueryEscape(fields[k]))
+	}
+
+	return b.String()
+}
+
+// ParseStructuredReason splits a reason built with StructuredReason back into its parts.
+// Reasons without a prefix return an empty prefix, and reasons without fields return a nil map.
+func ParseStructuredReason(reason string) (prefix string, message string, fields map[string]string) {
+	parts := strings.Split(reason, "|")
+	message = parts[0]
+	if spl := strings.SplitN(message, ": ", 2); len(spl) == 2 && !strings.Contains(spl[0], " ") {
+		prefix = spl[0]
+		message = spl[1]
+	}
+
+	for _, part := range parts[1:] {
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		k, err := url.QueryUnescape(k)
+		if err != nil {
+			continue
+		}
+		v, err = url.QueryUnescape(v)
+		if err != nil {
+			continue
+		}
+		if fields == nil {
+			fields = make(map[string]string, len(parts)-1)
+		}
+		fields[k] = v
+	}
+
+	return prefix, message, fields
+}
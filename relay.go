@@ -5,6 +5,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fasthttp/websocket"
@@ -29,24 +31,45 @@ func NewRelay() *Relay {
 			CheckOrigin:     func(r *http.Request) bool { return true },
 		},
 
-		clients:  xsync.NewMapOf[*websocket.Conn, struct{}](),
-		serveMux: &http.ServeMux{},
+		clients:  xsync.NewMapOf[*websocket.Conn, *WebSocket](),
+		firehose: xsync.NewMapOf[chan *nostr.Event, struct{}](),
+		shutdown: make(chan struct{}),
+		queries:  xsync.NewMapOf[string, *inflightQuery](),
+
+		eventsInFlight: xsync.NewMapOf[string, struct{}](),
+		serveMux:       &http.ServeMux{},
+
+		HandleDeletionsInternally: true,
+
+		AuthAttemptsWindow: time.Minute,
+		authAttempts:       newWindowCounter(),
 
 		WriteWait:      10 * time.Second,
 		PongWait:       60 * time.Second,
 		PingPeriod:     30 * time.Second,
 		MaxMessageSize: 512000,
+
+		MaxSubscriptions: 20,
 	}
 }
 
 type Relay struct {
 	ServiceURL string
 
+	// the context given to these functions is canceled as soon as the client disconnects (for the HTTP
+	// endpoints, when the request is done), except for OnDisconnect which runs right before that.
+	// QueryEvents, CountEvents and CountEventsHLL get a context that is also canceled when the subscription is
+	// closed, when the query is canceled with CancelQuery or after QueryTimeout, storages should watch it and
+	// stop early so no work is wasted on results nobody will read.
+	RejectConnection          []func(r *http.Request) bool
 	RejectEvent               []func(ctx context.Context, event *nostr.Event) (reject bool, msg string)
+	RejectDuplicateContent    []func(ctx context.Context, event *nostr.Event) (reject bool, msg string)
 	RejectFilter              []func(ctx context.Context, filter nostr.Filter) (reject bool, msg string)
 	RejectCountFilter         []func(ctx context.Context, filter nostr.Filter) (reject bool, msg string)
 	OverwriteDeletionOutcome  []func(ctx context.Context, target *nostr.Event, deletion *nostr.Event) (acceptDeletion bool, msg string)
 	OverwriteResponseEvent    []func(ctx context.Context, event *nostr.Event)
+	RejectResponseEvent       []func(ctx context.Context, event *nostr.Event) bool
+	OverwriteStoredEvent      []func(ctx context.Context, event *nostr.Event)
 	OverwriteFilter           []func(ctx context.Context, filter *nostr.Filter)
 	OverwriteCountFilter      []func(ctx context.Context, filter *nostr.Filter)
 	OverwriteRelayInformation []func(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument
@@ -54,14 +77,297 @@ type Relay struct {
 	DeleteEvent               []func(ctx context.Context, event *nostr.Event) error
 	QueryEvents               []func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
 	CountEvents               []func(ctx context.Context, filter nostr.Filter) (int64, error)
+	CountEventsHLL            []func(ctx context.Context, filter nostr.Filter, offset int) (int64, *HyperLogLog, error)
 	OnConnect                 []func(ctx context.Context)
 	OnDisconnect              []func(ctx context.Context)
+	OnShutdown                []func(ctx context.Context)
+	OnAuth                    []func(ctx context.Context, pubkey string)
 	OnEventSaved              []func(ctx context.Context, event *nostr.Event)
 	OnEphemeralEvent          []func(ctx context.Context, event *nostr.Event)
+	OnReport                  []func(ctx context.Context, report *nostr.Event)
+	OnEmptyResult             []func(ctx context.Context, subID string, filter nostr.Filter)
+	OnSubscription            []func(ctx context.Context, ws *WebSocket, subID string, filters nostr.Filters)
+
+	// if false, kind-5 events go through the normal AddEvent pipeline instead of being
+	// handled as NIP-09 deletion requests, so hooks have full control over deletions
+	HandleDeletionsInternally bool
+
+	// if true, the last MaxTombstones (10000 by default) events deleted by their authors are remembered so
+	// authenticated authors that ask for them by id are told they were deleted, see Tombstone
+	ServeTombstones bool
+	MaxTombstones   int
+
+	// if true events sent by clients are always rejected (calling AddEvent directly still works)
+	ReadOnly bool
+
+	// if set, replaceable and parameterized replaceable events with a created_at further than this in the future
+	// are rejected, and stored versions like that are replaced by any new version, so nobody can pin their version
+	// forever by dating it in the far future. PreventTimestampsInTheFuture does the same for all kinds.
+	MaxReplaceableFutureDrift time.Duration
+
+	// if true all REQ and COUNT requests are rejected, except the ones coming from connections
+	// authenticated as one of the WriteOnlyAdmins
+	WriteOnly       bool
+	WriteOnlyAdmins []string
+
+	// if true events with NIP-26 "delegation" tags are validated and rejected if the delegation is invalid
+	ResolveDelegation bool
+
+	// live events with a created_at further in the future than this are stored but not
+	// delivered to current subscribers (zero disables the check)
+	MaxDeliveryFutureDrift time.Duration
+
+	// if non-zero, a REQ rejected with "auth-required:" is remembered and handled again automatically
+	// if the client authenticates within this period
+	AutoRetryAfterAuth time.Duration
+
+	// limits on AUTH attempts (zero means unlimited): per connection during its whole lifetime
+	// and per IP during each AuthAttemptsWindow
+	MaxAuthAttemptsPerConnection int
+	MaxAuthAttemptsPerIP         int
+	AuthAttemptsWindow           time.Duration
+
+	// if not empty, /firehose streams all accepted events to these pubkeys (authenticated with NIP-98)
+	FirehoseAdmins []string
+
+	// if true /info/features serves a JSON description of the relay configuration
+	ServeFeatures bool
+
+	// relay URLs other than ServiceURL that are accepted in the "relay" tag of AUTH events,
+	// useful when the relay is reachable through multiple proxies or domains
+	AcceptedAuthURLs []string
+
+	// if set this is used instead of the default NIP-42 validation for AUTH messages
+	ValidateAuth func(ctx context.Context, authEvent *nostr.Event, challenge string) (pubkey string, ok bool)
+
+	// by default the "search" field is passed along to QueryEvents like everything else, set this
+	// to true if the storage doesn't support search so these filters are rejected instead of
+	// returning results that ignore the search term
+	RejectSearchWhenUnsupported bool
+
+	// if non-zero, the count for each COUNT filter stops at MaxCount, and if CountRespectsLimit is true also at the
+	// "limit" of the filter, for clients that only care about "up to N", and so does the total of all filters.
+	// Counts that were capped are sent with "approximate": true and without HyperLogLog registers, so they must
+	// be read as "at least".
+	MaxCount           int64
+	CountRespectsLimit bool
+
+	// filters that appear more than once in the same REQ are only queried once, set this to true to
+	// handle each of them separately as they came
+	KeepDuplicateFilters bool
+
+	// the scores given by all SpamScorers to an event are added up and if the total is greater than
+	// SpamThreshold the event is rejected, this allows combining many weak signals into one decision
+	SpamScorers   []func(ctx context.Context, event *nostr.Event) float64
+	SpamThreshold float64
+
+	// if set incoming events are sent to this service which decides if they can be stored
+	ModerationWebhook *ModerationWebhook
+
+	// if non-zero, filter limits are clamped to this value (filters without a limit get it too)
+	// and if NotifyOnClamp is true clients that asked for more get a NOTICE saying so
+	MaxLimit      int
+	NotifyOnClamp bool
+
+	// if true, the current versions of replaceable events are kept in memory when they're stored or loaded, and
+	// filters that ask for just one of them (one kind and one author, plus one "d" tag for parameterized ones)
+	// are answered from there without calling QueryEvents. At most MaxCachedReplaceables events are kept
+	// (10000 by default), the least recently used are dropped first. Only events that go through AddEvent and
+	// deletions done by the relay are seen, so the storage must not be changed from elsewhere.
+	CacheReplaceables     bool
+	MaxCachedReplaceables int
+
+	// if non-zero, filters with more authors than this are split into multiple queries with this many
+	// authors each, run one after the other. Events are sent as they arrive, without duplicates and up to
+	// the filter limit, so they're only sorted within each chunk
+	AuthorChunkSize int
+
+	// if non-zero, at most this many queries run at the same time across all connections,
+	// others wait for up to QueryQueueTimeout and are then rejected with "error: relay busy"
+	MaxConcurrentQueries int
+	QueryQueueTimeout    time.Duration
+
+	// if non-zero, the context of each QueryEvents and CountEvents call is canceled after this long, the
+	// events that arrive after that are not sent and the subscription goes on to EOSE with what it had
+	QueryTimeout time.Duration
+
+	// for the kinds in this map only the newest N events of each author are kept, older ones
+	// are deleted right after a new one is stored
+	RetentionByCount map[int]int
+
+	// ids of events that are always sent first to REQs whose filters they match. they're fetched once
+	// per REQ, like any other query, and sent at most once even if more than one of its filters match
+	PinnedEvents []string
+
+	// websocket subprotocols this relay accepts, in order of preference. if set, clients that request
+	// subprotocols but none of these are refused. the negotiated one is available on WebSocket.Subprotocol.
+	Subprotocols []string
+
+	// optional capabilities that clients can declare in the X-Nostr-Features header when connecting,
+	// the ones present in both are echoed back and can be checked with WebSocket.HasFeature
+	ConnectionFeatures []string
 
 	// editing info will affect
 	Info *nip11.RelayInformationDocument
 
+	// if set and returning true the NIP-11 document is not served for that request, a 404 is returned instead
+	HideNIP11 func(r *http.Request) bool
+
+	// optional identity of the relay itself, advertised on the NIP-11 "self" field.
+	// if SelfSecretKey is given Self is derived from it (ValidateInfo fails if both are set and don't
+	// match) and a "self_sig" field is added with a signature of the sha256 of ServiceURL, proving the
+	// relay controls the key.
+	Self          string
+	SelfSecretKey string
+
+	// if set together with SelfSecretKey, clients that negotiate AttestationFeature get each EVENT
+	// followed by an ATTESTATION signed with SelfSecretKey, see AttestationFeature for the format
+	SignedDelivery bool
+
+	// maximum number of concurrent subscriptions for each connection, REQs with a new subscription id
+	// beyond this are CLOSED (reusing an existing id doesn't count). Zero means no limit.
+	MaxSubscriptions int
+
+	// if non-zero, each connection can open at most this many subscriptions, counting every REQ and not only
+	// the ones still open, with the count going down by one every SubscriptionChurnDecay (a minute by default).
+	// REQs beyond that are CLOSED with "blocked: subscription churn limit exceeded". This catches clients that
+	// keep opening and closing subscriptions, which MaxSubscriptions doesn't.
+	MaxSubscriptionChurn   int
+	SubscriptionChurnDecay time.Duration
+
+	// if non-zero, at most this many websocket upgrades are handled at the same time,
+	// others get a 503 with Retry-After.
+	MaxConcurrentUpgrades int
+
+	// if true, NIP-40 expiration tags are enforced: expired events are rejected and never served, and events
+	// are deleted after they expire by a sweeper that runs every NIP40SweepInterval (defaults to one minute)
+	// between Start and Shutdown. The sweeper learns about stored events with an expiration from a scan of the
+	// storage when it starts and then as they are added, up to NIP40MaxScheduled of them (defaults to 100000)
+	// are kept in memory, when there are more the storage is scanned again once there is room.
+	EnableNIP40        bool
+	NIP40SweepInterval time.Duration
+	NIP40MaxScheduled  int
+
+	// if true, stored events can also be queried with an HTTP GET to /events, see HandleQuery
+	EnableHTTPQuery bool
+
+	// if true, permessage-deflate compression (RFC 7692) is used with clients that support it. Messages smaller
+	// than CompressionMinSize bytes, like most OK and EOSE messages, are sent uncompressed as compressing them
+	// costs more CPU than it saves bandwidth. Zero means everything is compressed.
+	EnableCompression  bool
+	CompressionMinSize int
+
+	// if set, counters of received messages and events are kept here, see HandleMetrics
+	Metrics *Metrics
+
+	// the period over which Throughput is averaged, one minute by default. It has a resolution of one second.
+	ThroughputWindow time.Duration
+
+	// if set, the storage functions aren't called for a while after they fail repeatedly and
+	// events, REQs and COUNTs are rejected with "error: relay temporarily unavailable" instead
+	CircuitBreaker *CircuitBreaker
+
+	// if set, REQs and COUNTs or EVENTs are rejected while the relay is overloaded, see LoadShedding
+	LoadShedding *LoadShedding
+
+	// if true, events can also be published with an HTTP POST to /event, see HandlePublish
+	EnableHTTPPublish bool
+
+	// if non-zero, messages to each connection go through a queue of this size instead of being written by whoever
+	// sends them (for example, the goroutine broadcasting an event), and connections whose queue gets full are closed.
+	WriteQueueSize int
+
+	// if non-zero, the total bytes waiting to be written to all connections is tracked and, whenever
+	// it goes over this, the connection with the most pending data is closed. See OutgoingBytes.
+	MaxTotalOutgoingBytes int
+
+	// if set, clients that declare the "zstd-dict" feature get their messages compressed with
+	// a zstd dictionary periodically trained on recent events
+	CompressionDictionary *CompressionDictionary
+
+	// if true, clients can sync with NIP-77 negentropy set reconciliation. The items are given by
+	// QueryNegentropyItems (they don't have to be sorted) or, if it isn't set, loaded with QueryEvents.
+	EnableNegentropy     bool
+	QueryNegentropyItems func(ctx context.Context, filter nostr.Filter) ([]NegentropyItem, error)
+
+	// decides the order hint given to QueryEvents functions for each filter, see GetQueryOrder.
+	// If nil DefaultQueryOrder is used.
+	ResolveQueryOrder func(ctx context.Context, filter nostr.Filter) QueryOrder
+
+	// if set, the stored events of each REQ are held until all of them are loaded and then sent before EOSE
+	// ordered by this priority for their kind, highest first (kinds not in the map have priority 0). For example,
+	// {0: 2, 3: 1} sends profiles, then contact lists, then everything else. This delays the first events.
+	DeliveryPriority map[int]int
+
+	// if true, a REQ in which all filters have "limit": -1 is treated as a subscription for live events only:
+	// no stored events are queried and no EOSE is sent (unlike "limit": 0, which still gets an EOSE).
+	AllowLiveOnlyMode bool
+
+	// if true, EOSE messages get the time at which the REQ was received as an extra element, like
+	// ["EOSE", <subscription id>, <unix timestamp>], so clients can use it as "since" when they reconnect instead
+	// of guessing from their own clocks. This is a khatru extension that only some clients understand, the
+	// others should ignore the extra element.
+	AppendServerTimeToEOSE bool
+
+	// if true, ["LIVE", <subscription id>] is sent as soon as a subscription is registered for live events, so
+	// clients know that from then on nothing is missed. It may come before or after the EOSE, as stored events can
+	// still be loading, and it's never sent for subscriptions that were closed or replaced before that.
+	SendLiveStartedMarker bool
+
+	// if true, the OK message for each accepted event tells how long it took to store it, like ": stored in 12ms",
+	// so client developers can spot slow writes. Otherwise the reason is empty as usual.
+	VerboseOK bool
+
+	// NIP-01 says a live event is sent once for each subscription it matches, so a connection with overlapping
+	// subscriptions gets it multiple times. If this is set it's only sent in the oldest matching subscription of
+	// each connection instead, which some clients prefer but isn't what the others expect.
+	DedupDeliveryPerConnection bool
+
+	// messages that can't be parsed are ignored, but if this is set a NOTICE will be sent back to help debugging clients.
+	NoticeOnInvalidMessage bool
+
+	// a CLOSE for a subscription id that doesn't exist in the connection (never opened or already closed)
+	// is ignored, but if this is set a NOTICE will be sent back to help debugging clients.
+	NoticeOnUnknownClose bool
+
+	// if set, this is called before a connection is established (for example, to look up an API key given
+	// in a header or in the query string) and the result is stored in WebSocket.Tier, see GetTier
+	ResolveConnectionTier func(r *http.Request) Tier
+
+	// if set, EVENT messages (and events published over HTTP) are rate-limited per IP with this,
+	// before they go through any other checks or the RejectEvent hooks
+	EventIPLimiter *IPRateLimiter
+
+	// signature schemes accepted for events, the first one that detects an event is used to verify it
+	// and events not detected by any are rejected. If empty only SchnorrSecp256k1 is used.
+	AcceptedSignatureSchemes []SignatureScheme
+
+	// if greater than zero, events sent by clients must have a NIP-13 proof of work of at least this many
+	// leading zero bits in their id, committed to in their "nonce" tag. If ResolveMinPOW is set it's used
+	// instead, so the difficulty can depend on the connection (for example, lower for authenticated users).
+	MinPOW        int
+	ResolveMinPOW func(ctx context.Context) int
+
+	// if set, live events are sent to each subscription at most at this rate, the excess is buffered or
+	// dropped. If ResolveDeliveryRateLimit is set it's called with the context of each REQ instead, so the
+	// rate can depend on the connection or its tier (see GetTier), and it can return nil for no limit.
+	DeliveryRateLimit        *DeliveryRate
+	ResolveDeliveryRateLimit func(ctx context.Context) *DeliveryRate
+
+	// if non-zero, event ids and signatures are verified by a pool of this many goroutines
+	// instead of in the goroutine handling each message.
+	VerifyWorkers int
+
+	// if non-zero, clients are sent an AUTH challenge as soon as they connect and the connection is closed
+	// with "auth-required: authentication timeout" if they haven't authenticated after this long. This applies
+	// to all connections, whether the policies of the relay require auth for anything or not, so it should only
+	// be set on relays that can't be used without authenticating.
+	UnauthenticatedGracePeriod time.Duration
+
+	// if non-zero, subscriptions that got no live events while the client sent nothing for this long
+	// are CLOSED. This is checked every PingPeriod.
+	SubscriptionIdleTimeout time.Duration
+
 	// Default logger, as set by NewServer, is a stdlib logger prefixed with "[khatru-relay] ",
 	// outputting to stderr.
 	Log *log.Logger
@@ -69,8 +375,77 @@ type Relay struct {
 	// for establishing websockets
 	upgrader websocket.Upgrader
 
-	// keep a connection reference to all connected clients for Server.Shutdown
-	clients *xsync.MapOf[*websocket.Conn, struct{}]
+	// keep a connection reference to all connected clients for Server.Shutdown and BroadcastNotice
+	clients *xsync.MapOf[*websocket.Conn, *WebSocket]
+
+	// channels of clients connected to the firehose
+	firehose *xsync.MapOf[chan *nostr.Event, struct{}]
+
+	// state for Shutdown, shutdownLock is held while connections are registered so none is missed
+	shuttingDown atomic.Bool
+	shutdownLock sync.Mutex
+	shutdownOnce sync.Once
+	shutdownErr  error
+	connections  sync.WaitGroup
+
+	// closed when Shutdown starts, for handlers that are not websockets and would otherwise keep it waiting
+	shutdown chan struct{}
+
+	// events waiting to be deleted because of EnableNIP40, and how to stop the sweeper
+	expirations     expirationQueue
+	stopExpirations context.CancelFunc
+
+	// accounting for MaxTotalOutgoingBytes
+	outgoing     *outgoingLimiter
+	outgoingOnce sync.Once
+
+	// signs delivery attestations, when SignedDelivery is enabled
+	attester     *attester
+	attesterOnce sync.Once
+
+	// worker pool for VerifyWorkers
+	verifyJobs     chan verifyJob
+	verifyPoolOnce sync.Once
+
+	// creates the timer for UnauthenticatedGracePeriod, see startTimer
+	timers func(d time.Duration) (<-chan time.Time, func() bool)
+
+	// semaphore for MaxConcurrentUpgrades
+	upgradeSlots     chan struct{}
+	upgradeSlotsOnce sync.Once
+
+	// semaphore for MaxConcurrentQueries
+	querySlots     chan struct{}
+	querySlotsOnce sync.Once
+
+	// queries currently running, for InFlightQueries and CancelQuery
+	queries  *xsync.MapOf[string, *inflightQuery]
+	queryIds atomic.Int64
+
+	// ids of the events AddEvent is working on, so the same event sent concurrently is only handled once
+	eventsInFlight *xsync.MapOf[string, struct{}]
+
+	// for CacheReplaceables
+	replaceables replaceableCache
+
+	// held by AddEvent while it replaces a replaceable event
+	replaceableLocks coordinateLocks
+
+	// for ServeTombstones
+	tombstones tombstones
+
+	// for Throughput
+	throughput throughputMeter
+
+	// the rendered NIP-11 document
+	nip11Cache nip11Cache
+
+	// AUTH attempts per IP
+	authAttempts *windowCounter
+
+	// fanout statistics for live events
+	broadcasted atomic.Int64
+	delivered   atomic.Int64
 
 	// in case you call Server.Start
 	Addr       string
@@ -0,0 +1,315 @@
+package khatru
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// memoryStore is a minimal thread-safe event store for the tests
+type memoryStore struct {
+	sync.Mutex
+	events []*nostr.Event
+}
+
+func (s *memoryStore) StoreEvent(ctx context.Context, evt *nostr.Event) error {
+	s.Lock()
+	defer s.Unlock()
+	s.events = append(s.events, evt)
+	return nil
+}
+
+func (s *memoryStore) DeleteEvent(ctx context.Context, evt *nostr.Event) error {
+	s.Lock()
+	defer s.Unlock()
+	for i, stored := range s.events {
+		if stored.ID == evt.ID {
+			s.events = append(s.events[:i], s.events[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) matching(filter nostr.Filter) []*nostr.Event {
+	s.Lock()
+	defer s.Unlock()
+	results := make([]*nostr.Event, 0, len(s.events))
+	for i := len(s.events) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(results) == filter.Limit {
+			break
+		}
+		if filter.Matches(s.events[i]) {
+			results = append(results, s.events[i])
+		}
+	}
+	return results
+}
+
+func (s *memoryStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	results := s.matching(filter)
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		for _, evt := range results {
+			select {
+			case ch <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (s *memoryStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	filter.Limit = 0
+	return int64(len(s.matching(filter))), nil
+}
+
+func (s *memoryStore) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.events)
+}
+
+// newTestRelay returns a relay backed by a memoryStore
+func newTestRelay() (*Relay, *memoryStore) {
+	rl := NewRelay()
+	rl.Log.SetOutput(io.Discard)
+	store := &memoryStore{}
+	rl.StoreEvent = append(rl.StoreEvent, store.StoreEvent)
+	rl.DeleteEvent = append(rl.DeleteEvent, store.DeleteEvent)
+	rl.QueryEvents = append(rl.QueryEvents, store.QueryEvents)
+	rl.CountEvents = append(rl.CountEvents, store.CountEvents)
+	return rl, store
+}
+
+// serve starts an HTTP server for the relay that is closed when the test ends
+func serve(t testing.TB, rl *Relay) string {
+	t.Helper()
+	server := httptest.NewServer(rl)
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+type testConn struct {
+	t        testing.TB
+	conn     *websocket.Conn
+	messages chan []json.RawMessage
+
+	// why the connection was closed, only set after messages is closed
+	closeErr error
+}
+
+func dial(t testing.TB, url string) *testConn {
+	t.Helper()
+	conn, _ := dialWith(t, websocket.DefaultDialer, url)
+	return conn
+}
+
+func dialWith(t testing.TB, dialer *websocket.Dialer, url string) (*testConn, *http.Response) {
+	t.Helper()
+	conn, resp, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// a read that times out breaks the connection, so they happen in the background and never time out
+	c := &testConn{t: t, conn: conn, messages: make(chan []json.RawMessage, 1000)}
+	go func() {
+		defer close(c.messages)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				c.closeErr = err
+				return
+			}
+			var msg []json.RawMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				msg = []json.RawMessage{json.RawMessage(`"INVALID"`), json.RawMessage(strconv.Quote(string(data)))}
+			}
+			c.messages <- msg
+		}
+	}()
+	return c, resp
+}
+
+func (c *testConn) send(msg ...any) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		c.t.Fatalf("failed to write: %s", err)
+	}
+}
+
+// read returns the next message from the relay or nil if nothing arrives within the timeout
+func (c *testConn) read(timeout time.Duration) []json.RawMessage {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("connection closed")
+		}
+		return msg
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+// until reads messages until one with the given label arrives, returning it along with everything read before
+func (c *testConn) until(label string) (found []json.RawMessage, before [][]json.RawMessage) {
+	c.t.Helper()
+	for {
+		msg := c.read(5 * time.Second)
+		if msg == nil {
+			c.t.Fatalf("timed out waiting for %s", label)
+		}
+		if messageLabel(msg) == label {
+			return msg, before
+		}
+		before = append(before, msg)
+	}
+}
+
+func messageLabel(msg []json.RawMessage) string {
+	var label string
+	if len(msg) > 0 {
+		json.Unmarshal(msg[0], &label)
+	}
+	return label
+}
+
+// messageEvent decodes the event from an ["EVENT", subid, event] message
+func messageEvent(t testing.TB, msg []json.RawMessage) *nostr.Event {
+	t.Helper()
+	if messageLabel(msg) != "EVENT" || len(msg) != 3 {
+		t.Fatalf("not an EVENT message: %s", msg)
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(msg[2], &evt); err != nil {
+		t.Fatalf("invalid event: %s", err)
+	}
+	return &evt
+}
+
+var testSecretKey = nostr.GeneratePrivateKey()
+
+// mkev makes an event signed by testSecretKey, or by the given secret key if any
+func mkev(t testing.TB, kind int, content string, tags nostr.Tags, sk ...string) *nostr.Event {
+	t.Helper()
+	evt := &nostr.Event{Kind: kind, Content: content, Tags: tags, CreatedAt: nostr.Now()}
+	key := testSecretKey
+	if len(sk) > 0 {
+		key = sk[0]
+	}
+	if err := evt.Sign(key); err != nil {
+		t.Fatalf("failed to sign: %s", err)
+	}
+	return evt
+}
+
+// waitFor polls the condition until it is true or fails the test after a few seconds
+func waitFor(t testing.TB, label string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", label)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// acceptAnyAuth can be used as ValidateAuth to authenticate clients as whoever signed the AUTH event
+func acceptAnyAuth(ctx context.Context, authEvent *nostr.Event, challenge string) (string, bool) {
+	ok, _ := authEvent.CheckSignature()
+	return authEvent.PubKey, ok && authEvent.Kind == 22242
+}
+
+// auth authenticates with the given secret key on a relay that uses acceptAnyAuth
+func (c *testConn) auth(sk string) {
+	c.t.Helper()
+	c.send("AUTH", mkev(c.t, 22242, "", nostr.Tags{{"challenge", "-"}}, sk))
+	if msg, _ := c.until("OK"); string(msg[2]) != "true" {
+		c.t.Fatalf("failed to authenticate: %s", msg)
+	}
+}
+
+// closed waits for the relay to close the connection and returns the close error
+func (c *testConn) closed(timeout time.Duration) error {
+	c.t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if !ok {
+				return c.closeErr
+			}
+		case <-deadline:
+			c.t.Fatalf("the connection wasn't closed")
+		}
+	}
+}
+
+// fakeClock creates timers that only fire when it is advanced, it can be used as Relay.timers
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+	stopped  bool
+}
+
+func (fc *fakeClock) timer(d time.Duration) (<-chan time.Time, func() bool) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	t := &fakeTimer{deadline: fc.now.Add(d), c: make(chan time.Time, 1)}
+	fc.timers = append(fc.timers, t)
+	return t.c, func() bool {
+		fc.mutex.Lock()
+		defer fc.mutex.Unlock()
+		wasActive := !t.stopped
+		t.stopped = true
+		return wasActive
+	}
+}
+
+// pending is the number of timers that didn't fire and weren't stopped
+func (fc *fakeClock) pending() int {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	n := 0
+	for _, t := range fc.timers {
+		if !t.stopped {
+			n++
+		}
+	}
+	return n
+}
+
+func (fc *fakeClock) advance(d time.Duration) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.now = fc.now.Add(d)
+	for _, t := range fc.timers {
+		if !t.stopped && !fc.now.Before(t.deadline) {
+			t.stopped = true
+			t.c <- fc.now
+		}
+	}
+}
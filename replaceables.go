@@ -0,0 +1,167 @@
+package khatru
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const defaultMaxCachedReplaceables = 10000
+
+// replaceableCache holds the current version of recently used replaceable events, see CacheReplaceables
+type replaceableCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     list.List // of *nostr.Event, most recently used first
+
+	// incremented when a cached event may have been deleted, so results of queries that were
+	// already running when that happened are not cached
+	generation uint64
+}
+
+func replaceableKey(kind int, pubkey string, dTag string) string {
+	return strconv.Itoa(kind) + ":" + pubkey + ":" + dTag
+}
+
+func replaceableEventKey(evt *nostr.Event) string {
+	var dTag string
+	if 30000 <= evt.Kind && evt.Kind < 40000 {
+		dTag = evt.Tags.GetD()
+	}
+	return replaceableKey(evt.Kind, evt.PubKey, dTag)
+}
+
+// replaceableFilterKey tells if a filter only asks for the current version of one replaceable
+// event, like someone's profile, and returns its key
+func replaceableFilterKey(filter nostr.Filter) (string, bool) {
+	if len(filter.IDs) > 0 || len(filter.Kinds) != 1 || len(filter.Authors) != 1 ||
+		filter.Since != nil || filter.Until != nil || filter.Search != "" {
+		return "", false
+	}
+
+	kind := filter.Kinds[0]
+	if !isReplaceable(kind) {
+		return "", false
+	}
+	if 30000 <= kind && kind < 40000 {
+		if len(filter.Tags) != 1 || len(filter.Tags["d"]) != 1 {
+			return "", false
+		}
+		return replaceableKey(kind, filter.Authors[0], filter.Tags["d"][0]), true
+	}
+	if len(filter.Tags) > 0 {
+		return "", false
+	}
+	return replaceableKey(kind, filter.Authors[0], ""), true
+}
+
+// get returns the cached event, if any, and the generation to give to offer later
+func (c *replaceableCache) get(key string) (*nostr.Event, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*nostr.Event), c.generation
+	}
+	return nil, c.generation
+}
+
+func (c *replaceableCache) currentGeneration() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generation
+}
+
+// offer caches the event unless the cached version is newer according to replaces, or something
+// was forgotten since generation was taken
+func (c *replaceableCache) offer(key string, evt *nostr.Event, generation uint64, max int, replaces func(previous, next *nostr.Event) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+	}
+
+	if el, ok := c.entries[key]; ok {
+		if replaces(el.Value.(*nostr.Event), evt) {
+			el.Value = evt
+		}
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(evt)
+	for c.lru.Len() > max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, replaceableEventKey(oldest.Value.(*nostr.Event)))
+	}
+}
+
+// forget removes a deleted event from the cache
+func (c *replaceableCache) forget(evt *nostr.Event) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	key := replaceableEventKey(evt)
+	if el, ok := c.entries[key]; ok && el.Value.(*nostr.Event).ID == evt.ID {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+func (rl *Relay) maxCachedReplaceables() int {
+	if rl.MaxCachedReplaceables > 0 {
+		return rl.MaxCachedReplaceables
+	}
+	return defaultMaxCachedReplaceables
+}
+
+// cacheReplaceable caches an event that was just stored or loaded from the storage
+func (rl *Relay) cacheReplaceable(key string, evt *nostr.Event, generation uint64) {
+	rl.replaceables.offer(key, cloneEvent(evt), generation, rl.maxCachedReplaceables(), rl.replaces)
+}
+
+// coordinateLocks serializes the handling of events with the same replaceable key
+type coordinateLocks struct {
+	mutex sync.Mutex
+	locks map[string]*coordinateLock
+}
+
+type coordinateLock struct {
+	sync.Mutex
+	waiting int
+}
+
+// lock waits until no other event with this key is being handled and returns the function that releases it
+func (cl *coordinateLocks) lock(key string) func() {
+	cl.mutex.Lock()
+	if cl.locks == nil {
+		cl.locks = make(map[string]*coordinateLock)
+	}
+	l, ok := cl.locks[key]
+	if !ok {
+		l = &coordinateLock{}
+		cl.locks[key] = l
+	}
+	l.waiting++
+	cl.mutex.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		cl.mutex.Lock()
+		l.waiting--
+		if l.waiting == 0 {
+			delete(cl.locks, key)
+		}
+		cl.mutex.Unlock()
+	}
+}
@@ -0,0 +1,28 @@
+package khatru
+
+import (
+	"context"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CountReports returns the number of distinct pubkeys with a NIP-56 report (kind 1984) stored against the
+// given event, reports by its own author are not counted. Each reporter counts once however many reports it
+// sent, so a single key can't get to any threshold by itself.
+func (rl *Relay) CountReports(ctx context.Context, target *nostr.Event) int64 {
+	filter := nostr.Filter{Kinds: []int{1984}, Tags: nostr.TagMap{"e": []string{target.ID}}}
+
+	reporters := make(map[string]struct{})
+	for _, query := range rl.QueryEvents {
+		ch, err := query(ctx, filter)
+		if err != nil {
+			continue
+		}
+		for report := range ch {
+			if report.PubKey != target.PubKey {
+				reporters[report.PubKey] = struct{}{}
+			}
+		}
+	}
+	return int64(len(reporters))
+}
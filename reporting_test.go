@@ -0,0 +1,53 @@
+package khatru
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestOnReport(t *testing.T) {
+	rl, _ := newTestRelay()
+	var reports []*nostr.Event
+	rl.OnReport = append(rl.OnReport, func(ctx context.Context, report *nostr.Event) {
+		reports = append(reports, report)
+	})
+
+	target := mkev(t, 1, "spam", nil)
+	report := mkev(t, 1984, "", nostr.Tags{{"e", target.ID, "spam"}})
+	for _, evt := range []*nostr.Event{target, report, mkev(t, 7, "+", nostr.Tags{{"e", target.ID}})} {
+		if err := rl.AddEvent(context.Background(), evt); err != nil {
+			t.Fatalf("failed to add: %s", err)
+		}
+	}
+
+	if len(reports) != 1 || reports[0].ID != report.ID {
+		t.Fatalf("expected OnReport to be called once with the report, got %v", reports)
+	}
+}
+
+func TestCountReports(t *testing.T) {
+	rl, store := newTestRelay()
+	author := nostr.GeneratePrivateKey()
+	target := mkev(t, 1, "spam", nil, author)
+	other := mkev(t, 1, "fine", nil)
+	for i := 0; i < 3; i++ {
+		store.StoreEvent(context.Background(), mkev(t, 1984, "", nostr.Tags{{"e", target.ID, "spam"}}, nostr.GeneratePrivateKey()))
+	}
+	// more reports by one of the same pubkeys, and by the author, don't count
+	for i := 0; i < 5; i++ {
+		store.StoreEvent(context.Background(), mkev(t, 1984, strconv.Itoa(i), nostr.Tags{{"e", target.ID, "spam"}}))
+		store.StoreEvent(context.Background(), mkev(t, 1984, strconv.Itoa(i), nostr.Tags{{"e", target.ID, "spam"}}, author))
+	}
+	store.StoreEvent(context.Background(), mkev(t, 1984, "", nostr.Tags{{"e", other.ID, "spam"}}))
+	store.StoreEvent(context.Background(), mkev(t, 1, "reply", nostr.Tags{{"e", target.ID}}))
+
+	if n := rl.CountReports(context.Background(), target); n != 4 {
+		t.Fatalf("expected 4 reporters, got %d", n)
+	}
+	if n := rl.CountReports(context.Background(), mkev(t, 1, "unreported", nil)); n != 0 {
+		t.Fatalf("expected no reporters, got %d", n)
+	}
+}
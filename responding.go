@@ -3,13 +3,94 @@ package khatru
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
-func (rl *Relay) handleRequest(ctx context.Context, id string, eose *sync.WaitGroup, ws *WebSocket, filter nostr.Filter) error {
-	defer eose.Done()
+// ErrBackendUnavailable can be returned (or wrapped) by QueryEvents functions to signal that the storage
+// is temporarily gone (for example, during a failover). Instead of just emitting a NOTICE the relay will then
+// CLOSE all subscriptions so clients know they have to resubscribe, see BackendUnavailable.
+var ErrBackendUnavailable = errors.New("backend unavailable")
+
+var errBackendUnavailable = errors.New("error: backend unavailable, please resubscribe")
+
+// BackendUnavailable sends a CLOSED telling clients to resubscribe to all subscriptions, the ones whose stored
+// events are still loading included, whose queries are canceled. It's called when a query returns
+// ErrBackendUnavailable and can also be called by a health check of the storage, for example when it notices a
+// failover. It returns the number of subscriptions closed.
+func (rl *Relay) BackendUnavailable() int {
+	return rl.CloseSubscriptionsMatching(func(nostr.Filters) bool { return true }, errBackendUnavailable.Error())
+}
+
+// eoseCounter coordinates the EOSE message of a REQ. It starts with one pending
+// unit per filter plus one held by the caller while filters are being dispatched.
+// Each of these must call done() exactly once and the callback fires when the count hits zero.
+type eoseCounter struct {
+	pending  atomic.Int64
+	callback func()
+}
+
+func newEOSECounter(filters int, callback func()) *eoseCounter {
+	c := &eoseCounter{callback: callback}
+	c.pending.Store(int64(filters) + 1)
+	return c
+}
+
+func (c *eoseCounter) done() {
+	if c.pending.Add(-1) == 0 {
+		c.callback()
+	}
+}
+
+// jsonWriter is where the results of handleRequest are written to, usually a *WebSocket
+type jsonWriter interface {
+	WriteJSON(any any) error
+}
+
+var errSubscriptionReplaced = errors.New("subscription replaced")
+
+// subscriptionWriter writes the messages of a REQ until its context is canceled, that is, until the EOSE is
+// sent or the REQ is closed, rejected or replaced by another REQ with the same id. stop cancels its context
+// and then waits for the write that may be happening, so once a REQ is stopped nothing else is sent for it.
+type subscriptionWriter struct {
+	mutex  sync.Mutex
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	w      jsonWriter
+}
+
+func (s *subscriptionWriter) stopped() bool {
+	return s.ctx.Err() != nil
+}
+
+func (s *subscriptionWriter) WriteJSON(any any) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped() {
+		return context.Cause(s.ctx)
+	}
+	return s.w.WriteJSON(any)
+}
+
+func (s *subscriptionWriter) stop(cause error) {
+	s.cancel(cause)
+	s.mutex.Lock()
+	s.mutex.Unlock()
+}
+
+// handleRequest dispatches the stored events for a single filter and calls eose.done() exactly once,
+// either immediately (when the filter is skipped or rejected) or after all queries have finished.
+// pinned is shared by all the filters of the same REQ.
+func (rl *Relay) handleRequest(ctx context.Context, id string, eose *eoseCounter, ws jsonWriter, filter nostr.Filter, pinned *pinnedEvents) error {
+	if err := rl.checkWriteOnly(ctx); err != nil {
+		eose.done()
+		return err
+	}
 
 	// overwrite the filter (for example, to eliminate some kinds or
 	// that we know we don't support)
@@ -20,9 +101,25 @@ func (rl *Relay) handleRequest(ctx context.Context, id string, eose *sync.WaitGr
 	if filter.Limit < 0 {
 		// this is a special situation through which the implementor signals to us that it doesn't want
 		// to event perform any queries whatsoever
+		for _, oer := range rl.OnEmptyResult {
+			oer(ctx, id, filter)
+		}
+		eose.done()
 		return nil
 	}
 
+	if rl.RejectSearchWhenUnsupported && filter.Search != "" {
+		eose.done()
+		return errors.New("unsupported: search is not available on this relay")
+	}
+
+	if rl.MaxLimit > 0 && (filter.Limit == 0 || filter.Limit > rl.MaxLimit) {
+		if filter.Limit > rl.MaxLimit && rl.NotifyOnClamp {
+			ws.WriteJSON(nostr.NoticeEnvelope(fmt.Sprintf("limit clamped to %d", rl.MaxLimit)))
+		}
+		filter.Limit = rl.MaxLimit
+	}
+
 	// then check if we'll reject this filter (we apply this after overwriting
 	// because we may, for example, remove some things from the incoming filters
 	// that we know we don't support, and then if the end result is an empty
@@ -30,58 +127,555 @@ func (rl *Relay) handleRequest(ctx context.Context, id string, eose *sync.WaitGr
 	for _, reject := range rl.RejectFilter {
 		if reject, msg := reject(ctx, filter); reject {
 			ws.WriteJSON(nostr.NoticeEnvelope(msg))
+			eose.done()
 			return errors.New(nostr.NormalizeOKMessage(msg, "blocked"))
 		}
 	}
 
+	var sent atomic.Int64
+
+	// pinned events that match this filter are always sent first
+	sent.Add(int64(rl.sendPinnedEvents(ctx, id, ws, filter, pinned)))
+
+	if rl.ServeTombstones {
+		rl.sendTombstones(ctx, id, ws, filter)
+	}
+
+	// lookups of a single replaceable event may be answered from memory
+	var cacheKey string
+	var cacheable bool
+	var generation uint64
+	if rl.CacheReplaceables {
+		cacheKey, cacheable = replaceableFilterKey(filter)
+	}
+	if cacheable {
+		var cached *nostr.Event
+		cached, generation = rl.replaceables.get(cacheKey)
+		if cached != nil && !(rl.EnableNIP40 && isExpired(cached)) {
+			if !pinned.has(cached.ID) {
+				event := cloneEvent(cached)
+				for _, ovw := range rl.OverwriteResponseEvent {
+					ovw(ctx, event)
+				}
+				if !rl.rejectResponseEvent(ctx, event) {
+					ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event})
+					sent.Add(1)
+				}
+			}
+			if sent.Load() == 0 {
+				for _, oer := range rl.OnEmptyResult {
+					oer(ctx, id, filter)
+				}
+			}
+			eose.done()
+			return nil
+		}
+	}
+
+	// otherwise the newest event loaded will be cached, unless something went wrong and we may have missed some
+	var newest *nostr.Event
+	var newestMutex sync.Mutex
+	var incomplete atomic.Bool
+
 	// run the functions to query events (generally just one,
 	// but we might be fetching stuff from multiple places)
-	eose.Add(len(rl.QueryEvents))
+	queries := sync.WaitGroup{}
 	for _, query := range rl.QueryEvents {
-		ch, err := query(ctx, filter)
-		if err != nil {
+		if rl.CircuitBreaker != nil && !rl.CircuitBreaker.allow() {
+			eose.done()
+			return errBreakerOpen
+		}
+		if !rl.acquireQuerySlot(ctx) {
+			if rl.CircuitBreaker != nil {
+				rl.CircuitBreaker.skip()
+			}
+			eose.done()
+			return errors.New("error: relay busy")
+		}
+
+		qctx, untrack := rl.trackQuery(ctx, id, filter)
+		var ch chan *nostr.Event
+		var err error
+		var wait func() error
+		if rl.AuthorChunkSize > 0 && len(filter.Authors) > rl.AuthorChunkSize {
+			// the chunks are queried in the background, errors are only known once they're done
+			ch, wait = rl.queryByAuthorChunks(qctx, query, filter)
+		} else {
+			ch, err = query(qctx, filter)
+		}
+		if err != nil && rl.CircuitBreaker != nil {
+			// otherwise it's only known how the query went once all its events were read
+			rl.CircuitBreaker.done(err)
+		}
+		if errors.Is(err, ErrBackendUnavailable) {
+			// this will cause the whole subscription to be CLOSED so the client can retry later, and all others too
+			untrack()
+			rl.releaseQuerySlot()
+			eose.done()
+			return errBackendUnavailable
+		} else if err != nil {
+			untrack()
+			rl.releaseQuerySlot()
 			ws.WriteJSON(nostr.NoticeEnvelope(err.Error()))
-			eose.Done()
+			incomplete.Store(true)
 			continue
 		}
 
-		go func(ch chan *nostr.Event) {
+		queries.Add(1)
+		go func(qctx context.Context, ch chan *nostr.Event, wait func() error, untrack func()) {
 			for event := range ch {
+				if qctx.Err() != nil {
+					// closed, canceled with CancelQuery or timed out, keep draining so the storage isn't stuck
+					// trying to send to us
+					continue
+				}
+				if pinned.has(event.ID) {
+					// already sent
+					continue
+				}
+				if rl.EnableNIP40 && isExpired(event) {
+					// never served, and the sweeper will delete it
+					rl.scheduleExpiration(event)
+					continue
+				}
+				if cacheable {
+					newestMutex.Lock()
+					if newest == nil || isOlder(newest, event) {
+						newest = cloneEvent(event)
+					}
+					newestMutex.Unlock()
+				}
 				for _, ovw := range rl.OverwriteResponseEvent {
 					ovw(ctx, event)
 				}
+				if rl.rejectResponseEvent(ctx, event) {
+					continue
+				}
 				ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event})
+				sent.Add(1)
+			}
+			if qctx.Err() != nil {
+				incomplete.Store(true)
 			}
-			eose.Done()
-		}(ch)
+			var err error
+			if wait != nil {
+				err = wait()
+			}
+			if rl.CircuitBreaker != nil {
+				if err != nil {
+					rl.CircuitBreaker.done(err)
+				} else {
+					rl.CircuitBreaker.queryDone(ctx, qctx)
+				}
+			}
+			untrack()
+			rl.releaseQuerySlot()
+			if errors.Is(err, ErrBackendUnavailable) {
+				rl.BackendUnavailable()
+			} else if err != nil {
+				ws.WriteJSON(nostr.NoticeEnvelope(err.Error()))
+				incomplete.Store(true)
+			}
+			queries.Done()
+		}(qctx, ch, wait, untrack)
 	}
 
+	// only signal EOSE for this filter after all queries are done and we had
+	// the chance to tell the client nothing was found
+	go func() {
+		queries.Wait()
+		if cacheable && newest != nil && !incomplete.Load() {
+			rl.cacheReplaceable(cacheKey, newest, generation)
+		}
+		if sent.Load() == 0 {
+			for _, oer := range rl.OnEmptyResult {
+				oer(ctx, id, filter)
+			}
+		}
+		eose.done()
+	}()
+
 	return nil
 }
 
-func (rl *Relay) handleCountRequest(ctx context.Context, ws *WebSocket, filter nostr.Filter) int64 {
+// prepareCountFilter applies the overwrite and reject functions to a COUNT filter. It returns an error with
+// a prefixed reason if the whole COUNT should be CLOSED. RejectFilter is applied after RejectCountFilter so
+// nobody can count what they wouldn't be allowed to read, and so is OverwriteFilter for anonymous clients.
+func (rl *Relay) prepareCountFilter(ctx context.Context, filter nostr.Filter) (nostr.Filter, error) {
 	// overwrite the filter (for example, to eliminate some kinds or tags that we know we don't support)
 	for _, ovw := range rl.OverwriteCountFilter {
 		ovw(ctx, &filter)
 	}
+	if GetAuthed(ctx) == "" {
+		for _, ovw := range rl.OverwriteFilter {
+			ovw(ctx, &filter)
+		}
+	}
+
+	if rl.RejectSearchWhenUnsupported && filter.Search != "" {
+		return filter, errors.New("unsupported: search is not available on this relay")
+	}
 
 	// then check if we'll reject this filter
-	for _, reject := range rl.RejectCountFilter {
+	for _, reject := range append(slices.Clip(rl.RejectCountFilter), rl.RejectFilter...) {
 		if rejecting, msg := reject(ctx, filter); rejecting {
-			ws.WriteJSON(nostr.NoticeEnvelope(msg))
-			return 0
+			return filter, errors.New(nostr.NormalizeOKMessage(msg, "blocked"))
+		}
+	}
+
+	return filter, nil
+}
+
+// handleCountRequest counts the events for a single filter that went through prepareCountFilter, applying
+// the same restrictions as handleRequest. The HyperLogLog is only returned if CountEventsHLL is used and
+// the count wasn't capped, see countBound.
+func (rl *Relay) handleCountRequest(ctx context.Context, ws *WebSocket, filter nostr.Filter) (int64, *HyperLogLog, bool, error) {
+	if filter.Limit < 0 {
+		// the overwrite functions said nothing should be counted, the same as for handleRequest
+		return 0, nil, false, nil
+	}
+
+	// storages that can produce HyperLogLog registers are preferred, the others just give us a number
+	offset := HyperLogLogOffset(filter)
+	counts := make([]countFunc, 0, len(rl.CountEventsHLL)+len(rl.CountEvents))
+	for _, count := range rl.CountEventsHLL {
+		counts = append(counts, func(ctx context.Context, filter nostr.Filter) (int64, *HyperLogLog, error) {
+			return count(ctx, filter, offset)
+		})
+	}
+	if len(counts) == 0 {
+		for _, count := range rl.CountEvents {
+			counts = append(counts, func(ctx context.Context, filter nostr.Filter) (int64, *HyperLogLog, error) {
+				res, err := count(ctx, filter)
+				return res, nil, err
+			})
 		}
 	}
 
 	// run the functions to count (generally it will be just one)
+	bound := rl.countBound(filter)
 	var subtotal int64 = 0
-	for _, count := range rl.CountEvents {
-		res, err := count(ctx, filter)
+	var hll *HyperLogLog
+	var stopped bool
+	for _, count := range counts {
+		if bound > 0 && subtotal >= bound {
+			// the others may only add to it
+			stopped = true
+			break
+		}
+		if rl.CircuitBreaker != nil && !rl.CircuitBreaker.allow() {
+			return 0, nil, false, errBreakerOpen
+		}
+		if !rl.acquireQuerySlot(ctx) {
+			if rl.CircuitBreaker != nil {
+				rl.CircuitBreaker.skip()
+			}
+			return 0, nil, false, errors.New("error: relay busy")
+		}
+
+		var res int64
+		var rhll *HyperLogLog
+		var err error
+		cctx, cancel := rl.withQueryTimeout(ctx)
+		if rl.AuthorChunkSize > 0 && len(filter.Authors) > rl.AuthorChunkSize {
+			res, rhll, err = rl.countByAuthorChunks(cctx, count, filter)
+		} else {
+			res, rhll, err = count(cctx, filter)
+		}
+		cancel()
+		rl.releaseQuerySlot()
+		if rl.CircuitBreaker != nil {
+			rl.CircuitBreaker.done(err)
+		}
 		if err != nil {
 			ws.WriteJSON(nostr.NoticeEnvelope(err.Error()))
 		}
 		subtotal += res
+		hll = mergeHyperLogLog(hll, rhll)
+	}
+
+	if stopped || (bound > 0 && subtotal > bound) {
+		return bound, nil, true, nil
+	}
+	return subtotal, hll, false, nil
+}
+
+// countBound is where counting can stop for a filter, zero if it must go all the way
+func (rl *Relay) countBound(filter nostr.Filter) int64 {
+	bound := rl.MaxCount
+	if rl.CountRespectsLimit && filter.Limit > 0 && (bound <= 0 || int64(filter.Limit) < bound) {
+		bound = int64(filter.Limit)
 	}
+	return bound
+}
+
+type countFunc func(ctx context.Context, filter nostr.Filter) (int64, *HyperLogLog, error)
+
+// mergeHyperLogLog merges b into a, allocating a if it's nil
+func mergeHyperLogLog(a *HyperLogLog, b *HyperLogLog) *HyperLogLog {
+	if b == nil {
+		return a
+	}
+	if a == nil {
+		a = NewHyperLogLog(b.offset)
+	}
+	a.Merge(b)
+	return a
+}
+
+// countByAuthorChunks runs the count once for each AuthorChunkSize authors in the filter and sums the results,
+// since each event has a single author the chunks never overlap as long as the authors are deduplicated.
+func (rl *Relay) countByAuthorChunks(ctx context.Context, count countFunc, filter nostr.Filter) (int64, *HyperLogLog, error) {
+	authors := slices.Clone(filter.Authors)
+	slices.Sort(authors)
+	authors = slices.Compact(authors)
+
+	var total int64
+	var hll *HyperLogLog
+	for i := 0; i < len(authors); i += rl.AuthorChunkSize {
+		chunk := filter
+		chunk.Authors = authors[i:min(i+rl.AuthorChunkSize, len(authors))]
+
+		res, chll, err := count(ctx, chunk)
+		if err != nil {
+			return total, hll, err
+		}
+		total += res
+		hll = mergeHyperLogLog(hll, chll)
+	}
+	return total, hll, nil
+}
+
+// acquireQuerySlot waits for one of the MaxConcurrentQueries slots (for up to QueryQueueTimeout)
+// and returns false if it couldn't get one. Each successful call must be paired with releaseQuerySlot.
+func (rl *Relay) acquireQuerySlot(ctx context.Context) bool {
+	if rl.MaxConcurrentQueries <= 0 {
+		return true
+	}
+	rl.querySlotsOnce.Do(func() {
+		rl.querySlots = make(chan struct{}, rl.MaxConcurrentQueries)
+	})
+
+	select {
+	case rl.querySlots <- struct{}{}:
+		return true
+	default:
+	}
+	if rl.QueryQueueTimeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(rl.QueryQueueTimeout)
+	defer timer.Stop()
+	select {
+	case rl.querySlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (rl *Relay) releaseQuerySlot() {
+	if rl.MaxConcurrentQueries > 0 {
+		<-rl.querySlots
+	}
+}
 
-	return subtotal
+// queryByAuthorChunks runs the query once for each AuthorChunkSize authors in the filter, one chunk after the
+// other, and sends the events to the returned channel as they arrive, without duplicates and up to the filter
+// limit. It returns right away, the first error stops it and is returned by wait once the channel is closed.
+func (rl *Relay) queryByAuthorChunks(
+	ctx context.Context,
+	query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error),
+	filter nostr.Filter,
+) (ch chan *nostr.Event, wait func() error) {
+	ch = make(chan *nostr.Event)
+	var err error
+	go func() {
+		defer close(ch)
+		seen := make(map[string]struct{})
+		for i := 0; i < len(filter.Authors); i += rl.AuthorChunkSize {
+			chunk := filter
+			chunk.Authors = filter.Authors[i:min(i+rl.AuthorChunkSize, len(filter.Authors))]
+
+			var res chan *nostr.Event
+			res, err = query(ctx, chunk)
+			if err != nil {
+				return
+			}
+			for event := range res {
+				if _, ok := seen[event.ID]; ok || ctx.Err() != nil {
+					// keep draining so the storage isn't stuck trying to send to us
+					continue
+				}
+				if filter.Limit > 0 && len(seen) >= filter.Limit {
+					continue
+				}
+				seen[event.ID] = struct{}{}
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+				}
+			}
+			if ctx.Err() != nil || (filter.Limit > 0 && len(seen) >= filter.Limit) {
+				return
+			}
+		}
+	}()
+	return ch, func() error { return err }
+}
+
+// pinnedEvents holds the PinnedEvents for a REQ, which are only fetched once for all its filters, and
+// those that were sent already, so one that matches more than one filter isn't sent twice.
+type pinnedEvents struct {
+	once   sync.Once
+	events map[string]*nostr.Event
+	mutex  sync.Mutex
+	sent   map[string]struct{}
+}
+
+func (p *pinnedEvents) has(id string) bool {
+	_, ok := p.events[id]
+	return ok
+}
+
+// sendPinnedEvents sends the PinnedEvents that match the filter and weren't sent yet for this REQ and
+// returns how many were sent. They're fetched the first time it's called.
+func (rl *Relay) sendPinnedEvents(ctx context.Context, id string, ws jsonWriter, filter nostr.Filter, pinned *pinnedEvents) int {
+	if len(rl.PinnedEvents) == 0 {
+		return 0
+	}
+	pinned.once.Do(func() {
+		pinned.events = rl.loadPinnedEvents(ctx, id)
+		pinned.sent = make(map[string]struct{}, len(pinned.events))
+	})
+
+	sent := 0
+	for _, pid := range rl.PinnedEvents {
+		stored, ok := pinned.events[pid]
+		if !ok || !filter.Matches(stored) {
+			continue
+		}
+		pinned.mutex.Lock()
+		_, done := pinned.sent[pid]
+		pinned.sent[pid] = struct{}{}
+		pinned.mutex.Unlock()
+		if done {
+			continue
+		}
+
+		event := cloneEvent(stored)
+		for _, ovw := range rl.OverwriteResponseEvent {
+			ovw(ctx, event)
+		}
+		if rl.rejectResponseEvent(ctx, event) {
+			continue
+		}
+		ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &id, Event: *event})
+		sent++
+	}
+	return sent
+}
+
+// loadPinnedEvents fetches the PinnedEvents like any other query, so it goes through the breaker, waits for
+// a query slot and can be seen and canceled in InFlightQueries. Expired ones are left out.
+func (rl *Relay) loadPinnedEvents(ctx context.Context, id string) map[string]*nostr.Event {
+	events := make(map[string]*nostr.Event, len(rl.PinnedEvents))
+	filter := nostr.Filter{IDs: rl.PinnedEvents}
+	for _, query := range rl.QueryEvents {
+		if rl.CircuitBreaker != nil && !rl.CircuitBreaker.allow() {
+			break
+		}
+		if !rl.acquireQuerySlot(ctx) {
+			if rl.CircuitBreaker != nil {
+				rl.CircuitBreaker.skip()
+			}
+			break
+		}
+
+		qctx, untrack := rl.trackQuery(ctx, id, filter)
+		ch, err := query(qctx, filter)
+		if err != nil {
+			if rl.CircuitBreaker != nil {
+				rl.CircuitBreaker.done(err)
+			}
+		} else {
+			for event := range ch {
+				if _, ok := events[event.ID]; ok || qctx.Err() != nil {
+					continue
+				}
+				if rl.EnableNIP40 && isExpired(event) {
+					rl.scheduleExpiration(event)
+					continue
+				}
+				events[event.ID] = event
+			}
+			if rl.CircuitBreaker != nil {
+				rl.CircuitBreaker.queryDone(ctx, qctx)
+			}
+		}
+		untrack()
+		rl.releaseQuerySlot()
+	}
+	return events
+}
+
+// uniqueFilters returns the filters without the ones that are equal to a previous one
+func uniqueFilters(filters nostr.Filters) nostr.Filters {
+	unique := make(nostr.Filters, 0, len(filters))
+	for _, filter := range filters {
+		if !slices.ContainsFunc(unique, func(u nostr.Filter) bool {
+			return u.Limit == filter.Limit && nostr.FilterEqual(u, filter)
+		}) {
+			unique = append(unique, filter)
+		}
+	}
+	return unique
+}
+
+// isLiveOnly tells if all filters are marked with "limit": -1, which under AllowLiveOnlyMode means
+// the client only wants live events, without stored events and without an EOSE
+func isLiveOnly(filters nostr.Filters) bool {
+	for _, filter := range filters {
+		if filter.Limit >= 0 {
+			return false
+		}
+	}
+	return len(filters) > 0
+}
+
+// checkLiveOnlyFilter runs the checks of handleRequest that apply to a filter that will never be queried
+func (rl *Relay) checkLiveOnlyFilter(ctx context.Context, filter nostr.Filter) error {
+	if err := rl.checkWriteOnly(ctx); err != nil {
+		return err
+	}
+
+	for _, ovw := range rl.OverwriteFilter {
+		ovw(ctx, &filter)
+	}
+	for _, reject := range rl.RejectFilter {
+		if reject, msg := reject(ctx, filter); reject {
+			return errors.New(nostr.NormalizeOKMessage(msg, "blocked"))
+		}
+	}
+	return nil
+}
+
+// checkWriteOnly returns an error when reads are forbidden for this connection because of WriteOnly.
+func (rl *Relay) checkWriteOnly(ctx context.Context) error {
+	if !rl.WriteOnly {
+		return nil
+	}
+	if len(rl.WriteOnlyAdmins) > 0 {
+		authed := GetAuthed(ctx)
+		if authed == "" {
+			return errors.New("auth-required: this relay only serves reads to authenticated admins")
+		}
+		if slices.Contains(rl.WriteOnlyAdmins, authed) {
+			return nil
+		}
+	}
+	return errors.New("restricted: this relay does not serve reads")
 }
@@ -0,0 +1,422 @@
+package khatru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func countOf(t *testing.T, msg []json.RawMessage) int64 {
+	t.Helper()
+	var res struct {
+		Count int64 `json:"count"`
+	}
+	if messageLabel(msg) != "COUNT" || len(msg) != 3 || json.Unmarshal(msg[2], &res) != nil {
+		t.Fatalf("not a COUNT response: %s", msg)
+	}
+	return res.Count
+}
+
+func TestCountSkippedWhenOverwriteSetsNegativeLimit(t *testing.T) {
+	rl, store := newTestRelay()
+	for i := 0; i < 3; i++ {
+		store.StoreEvent(context.Background(), mkev(t, 4, "secret", nil))
+	}
+	rl.OverwriteFilter = append(rl.OverwriteFilter, func(ctx context.Context, filter *nostr.Filter) {
+		if GetAuthed(ctx) == "" {
+			filter.Limit = -1
+		}
+	})
+	rl.CountEvents = append(rl.CountEvents[:0], func(ctx context.Context, filter nostr.Filter) (int64, error) {
+		if filter.Limit < 0 {
+			t.Errorf("CountEvents called for a filter that shouldn't be counted")
+		}
+		return store.CountEvents(ctx, filter)
+	})
+
+	client := dial(t, serve(t, rl))
+	client.send("COUNT", "c", nostr.Filter{Kinds: []int{4}})
+	if msg, _ := client.until("COUNT"); countOf(t, msg) != 0 {
+		t.Fatalf("expected a count of 0, got %s", msg)
+	}
+}
+
+func TestCountAppliesRejectFilterToAuthenticatedClients(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.ValidateAuth = acceptAnyAuth
+	author := nostr.GeneratePrivateKey()
+	authorPubKey, _ := nostr.GetPublicKey(author)
+	store.StoreEvent(context.Background(), mkev(t, 4, "secret", nil, author))
+
+	// like policies.RejectKind04Snoopers, only the author can read their DMs
+	rl.RejectFilter = append(rl.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if len(filter.Kinds) == 1 && filter.Kinds[0] == 4 {
+			if authed := GetAuthed(ctx); authed == "" {
+				return true, "auth-required: we can't serve DMs to unauthenticated users"
+			} else if len(filter.Authors) != 1 || filter.Authors[0] != authed {
+				return true, "restricted: that's not your DM"
+			}
+		}
+		return false, ""
+	})
+
+	url := serve(t, rl)
+	snooper := dial(t, url)
+	snooper.auth(nostr.GeneratePrivateKey())
+	snooper.send("COUNT", "c", nostr.Filter{Kinds: []int{4}, Authors: []string{authorPubKey}})
+	msg, _ := snooper.until("CLOSED")
+	var reason string
+	json.Unmarshal(msg[2], &reason)
+	if !HasReasonPrefix(reason, PrefixRestricted) {
+		t.Fatalf("expected the COUNT to be restricted, got %s", msg)
+	}
+
+	owner := dial(t, url)
+	owner.auth(author)
+	owner.send("COUNT", "c", nostr.Filter{Kinds: []int{4}, Authors: []string{authorPubKey}})
+	if msg, _ := owner.until("COUNT"); countOf(t, msg) != 1 {
+		t.Fatalf("expected a count of 1, got %s", msg)
+	}
+}
+
+func TestEOSECounterFiresOnce(t *testing.T) {
+	for round := 0; round < 1000; round++ {
+		filters := round%8 + 1
+		var fired atomic.Int64
+		var pending atomic.Int64
+		pending.Store(int64(filters) + 1)
+		eose := newEOSECounter(filters, func() {
+			if pending.Load() != 0 {
+				t.Errorf("EOSE fired with %d filters still pending", pending.Load())
+			}
+			fired.Add(1)
+		})
+
+		var wg sync.WaitGroup
+		for i := 0; i < filters+1; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pending.Add(-1)
+				eose.done()
+			}()
+		}
+		wg.Wait()
+
+		if n := fired.Load(); n != 1 {
+			t.Fatalf("expected EOSE to fire once with %d filters, fired %d times", filters, n)
+		}
+	}
+}
+
+func TestEOSEAfterAllFiltersOfConcurrentReqs(t *testing.T) {
+	rl, store := newTestRelay()
+	for kind := 1; kind <= 4; kind++ {
+		for i := 0; i < 5; i++ {
+			store.StoreEvent(context.Background(), mkev(t, kind, "", nil))
+		}
+	}
+	// each filter path finishes in a different way: with events, empty, or skipped
+	rl.OverwriteFilter = append(rl.OverwriteFilter, func(ctx context.Context, filter *nostr.Filter) {
+		if len(filter.Kinds) == 1 && filter.Kinds[0] == 4 {
+			filter.Limit = -1
+		}
+	})
+	rl.QueryEvents = append(rl.QueryEvents[:0], func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		// the filters of a REQ finish in random order
+		time.Sleep(time.Duration(len(filter.Kinds)) * time.Millisecond)
+		return store.QueryEvents(ctx, filter)
+	})
+
+	client := dial(t, serve(t, rl))
+	filters := []any{
+		nostr.Filter{Kinds: []int{1}},
+		nostr.Filter{Kinds: []int{2, 3}},
+		nostr.Filter{Kinds: []int{4}},
+		nostr.Filter{Kinds: []int{5}},
+	}
+	const reqs = 10
+	for i := 0; i < reqs; i++ {
+		client.send(append([]any{"REQ", fmt.Sprint(i)}, filters...)...)
+	}
+
+	events := make(map[string]int)
+	eoses := make(map[string]int)
+	for len(eoses) < reqs {
+		msg := client.read(5 * time.Second)
+		if msg == nil {
+			t.Fatalf("timed out with %d EOSEs", len(eoses))
+		}
+		var id string
+		json.Unmarshal(msg[1], &id)
+		switch messageLabel(msg) {
+		case "EVENT":
+			if eoses[id] > 0 {
+				t.Fatalf("event after EOSE for %s", id)
+			}
+			events[id]++
+		case "EOSE":
+			eoses[id]++
+		}
+	}
+	if msg := client.read(100 * time.Millisecond); msg != nil {
+		t.Fatalf("unexpected message %s", msg)
+	}
+	for i := 0; i < reqs; i++ {
+		id := fmt.Sprint(i)
+		if events[id] != 15 || eoses[id] != 1 {
+			t.Fatalf("expected 15 events and one EOSE for %s, got %d and %d", id, events[id], eoses[id])
+		}
+	}
+}
+
+func TestCountChecksAllFiltersFirst(t *testing.T) {
+	rl, store := newTestRelay()
+	var counted atomic.Int64
+	rl.CountEvents = append(rl.CountEvents[:0], func(ctx context.Context, filter nostr.Filter) (int64, error) {
+		counted.Add(1)
+		return store.CountEvents(ctx, filter)
+	})
+	rl.RejectCountFilter = append(rl.RejectCountFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		return len(filter.Kinds) == 0, "invalid: kinds are required"
+	})
+	// the same restrictions as for REQ
+	rl.RejectFilter = append(rl.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		return len(filter.Authors) > 2, "too many authors"
+	})
+
+	client := dial(t, serve(t, rl))
+	closedWith := func(filters ...any) string {
+		client.send(append([]any{"COUNT", "c"}, filters...)...)
+		msg, _ := client.until("CLOSED")
+		var reason string
+		json.Unmarshal(msg[2], &reason)
+		return reason
+	}
+
+	if reason := closedWith(nostr.Filter{Kinds: []int{1}}, nostr.Filter{Kinds: []int{2}}, nostr.Filter{}); reason != "invalid: kinds are required" {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+	if reason := closedWith(nostr.Filter{Kinds: []int{1}}, nostr.Filter{Kinds: []int{1}, Authors: []string{"a", "b", "c"}}); reason != "blocked: too many authors" {
+		t.Fatalf("unexpected reason %q", reason)
+	}
+	if n := counted.Load(); n != 0 {
+		t.Fatalf("counted %d filters of rejected COUNTs", n)
+	}
+
+	client.send("REQ", "r", nostr.Filter{Kinds: []int{1}, Authors: []string{"a", "b", "c"}})
+	msg, _ := client.until("CLOSED")
+	if string(msg[2]) != `"blocked: too many authors"` {
+		t.Fatalf("expected the REQ to be blocked the same way, got %s", msg)
+	}
+
+	client.send("COUNT", "c", nostr.Filter{Kinds: []int{1}}, nostr.Filter{Kinds: []int{2}})
+	client.until("COUNT")
+	if n := counted.Load(); n != 2 {
+		t.Fatalf("expected 2 filters to be counted, got %d", n)
+	}
+}
+
+func TestReqWithDuplicateFilters(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		rl, store := newTestRelay()
+		rl.KeepDuplicateFilters = keep
+		store.StoreEvent(context.Background(), mkev(t, 1, "", nil))
+		store.StoreEvent(context.Background(), mkev(t, 2, "", nil))
+		var queried atomic.Int64
+		rl.QueryEvents = append(rl.QueryEvents[:0], func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+			queried.Add(1)
+			return store.QueryEvents(ctx, filter)
+		})
+
+		client := dial(t, serve(t, rl))
+		client.send("REQ", "a",
+			nostr.Filter{Kinds: []int{1}, Limit: 10},
+			nostr.Filter{Kinds: []int{2}},
+			nostr.Filter{Kinds: []int{1}, Limit: 10},
+		)
+		_, before := client.until("EOSE")
+		if msg := client.read(100 * time.Millisecond); msg != nil {
+			t.Fatalf("unexpected message after EOSE %s", msg)
+		}
+
+		expected := 2
+		if keep {
+			expected = 3
+		}
+		if n := queried.Load(); n != int64(expected) {
+			t.Fatalf("KeepDuplicateFilters: %v, expected %d queries, got %d", keep, expected, n)
+		}
+		if len(before) != expected {
+			t.Fatalf("KeepDuplicateFilters: %v, expected %d events, got %d", keep, expected, len(before))
+		}
+	}
+}
+
+func TestBackendUnavailableClosesAllSubscriptions(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.QueryEvents = []func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error){
+		func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+			switch filter.Kinds[0] {
+			case 2:
+				// loads forever
+				ch := make(chan *nostr.Event)
+				go func() {
+					<-ctx.Done()
+					close(ch)
+				}()
+				return ch, nil
+			case 3:
+				return nil, fmt.Errorf("failing over: %w", ErrBackendUnavailable)
+			default:
+				return store.QueryEvents(ctx, filter)
+			}
+		},
+	}
+	url := serve(t, rl)
+	live := dial(t, url)
+	loading := dial(t, url)
+	failing := dial(t, url)
+	publisher := dial(t, url)
+
+	live.send("REQ", "live", nostr.Filter{Kinds: []int{1}})
+	live.until("EOSE")
+	loading.send("REQ", "loading", nostr.Filter{Kinds: []int{1}}, nostr.Filter{Kinds: []int{2}})
+	waitFor(t, "query", func() bool { return len(rl.InFlightQueries()) == 1 })
+
+	failing.send("REQ", "failing", nostr.Filter{Kinds: []int{3}})
+	for _, client := range []*testConn{failing, live, loading} {
+		msg, before := client.until("CLOSED")
+		if string(msg[2]) != `"error: backend unavailable, please resubscribe"` {
+			t.Fatalf("unexpected CLOSED %s", msg)
+		}
+		for _, msg := range before {
+			if label := messageLabel(msg); label == "EOSE" || label == "CLOSED" {
+				t.Fatalf("unexpected %s before the CLOSED", msg)
+			}
+		}
+	}
+	waitFor(t, "queries to be canceled", func() bool { return len(rl.InFlightQueries()) == 0 })
+	if n := rl.ActiveSubscriptions(); n != 0 {
+		t.Fatalf("expected no subscriptions left, got %d", n)
+	}
+
+	publisher.send("EVENT", mkev(t, 1, "live", nil))
+	publisher.until("OK")
+	for _, client := range []*testConn{failing, live, loading} {
+		if msg := client.read(100 * time.Millisecond); msg != nil {
+			t.Fatalf("got %s after the CLOSED", msg)
+		}
+	}
+}
+
+func TestAuthorChunksAreStreamed(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.AuthorChunkSize = 2
+	authors := []string{nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey(), nostr.GeneratePrivateKey()}
+	for i, sk := range authors {
+		store.StoreEvent(context.Background(), mkev(t, 1, fmt.Sprint(i), nil, sk))
+		pk, _ := nostr.GetPublicKey(sk)
+		authors[i] = pk
+	}
+	rl.QueryEvents = []func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error){
+		func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+			if len(filter.Authors) > 0 && filter.Authors[0] == authors[2] {
+				// the second chunk loads forever
+				ch := make(chan *nostr.Event)
+				go func() {
+					<-ctx.Done()
+					close(ch)
+				}()
+				return ch, nil
+			}
+			// and the first one ignores the authors, so it has duplicates
+			filter.Authors = nil
+			return store.QueryEvents(ctx, filter)
+		},
+	}
+	conn := dial(t, serve(t, rl))
+
+	conn.send("REQ", "chunked", nostr.Filter{Authors: authors})
+	conn.send("REQ", "other", nostr.Filter{Kinds: []int{1}})
+	chunked, otherDone := 0, false
+	for chunked < 3 || !otherDone {
+		msg := conn.read(time.Second)
+		switch {
+		case msg == nil:
+			t.Fatalf("expected the events of the first chunk and the other REQ, got %d and %v", chunked, otherDone)
+		case string(msg[1]) != `"chunked"`:
+			otherDone = otherDone || messageLabel(msg) == "EOSE"
+		case messageLabel(msg) == "EVENT":
+			chunked++
+		default:
+			t.Fatalf("unexpected %s while the second chunk is loading", msg)
+		}
+	}
+	conn.send("CLOSE", "chunked")
+	if msg := conn.read(200 * time.Millisecond); msg != nil {
+		t.Fatalf("unexpected %s", msg)
+	}
+
+	conn.send("REQ", "limited", nostr.Filter{Authors: authors[0:2], Limit: 2})
+	found, before := conn.until("EOSE")
+	if string(found[1]) != `"limited"` || len(before) != 2 {
+		t.Fatalf("expected 2 events, got %v", before)
+	}
+}
+
+func TestPinnedEventsAreFetchedOncePerReq(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.EnableNIP40 = true
+	pinned := mkev(t, 1, "pinned", nil)
+	expired := mkev(t, 1, "expired", nostr.Tags{{"expiration", fmt.Sprint(nostr.Now() - 10)}})
+	store.StoreEvent(context.Background(), pinned)
+	store.StoreEvent(context.Background(), expired)
+	rl.PinnedEvents = []string{pinned.ID, expired.ID}
+
+	var fetched atomic.Int32
+	rl.QueryEvents = []func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error){
+		func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+			if len(filter.IDs) > 0 {
+				fetched.Add(1)
+			}
+			return store.QueryEvents(ctx, filter)
+		},
+	}
+	conn := dial(t, serve(t, rl))
+
+	conn.send("REQ", "pins", nostr.Filter{Kinds: []int{1}}, nostr.Filter{Authors: []string{pinned.PubKey}})
+	_, before := conn.until("EOSE")
+	if len(before) != 1 || messageEvent(t, before[0]).ID != pinned.ID {
+		t.Fatalf("expected only the pinned event, once, got %v", before)
+	}
+	if n := fetched.Load(); n != 1 {
+		t.Fatalf("expected the pinned events to be fetched once, got %d", n)
+	}
+}
+
+func TestCountTotalIsCappedAtMaxCount(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.MaxCount = 5
+	for i := 0; i < 4; i++ {
+		store.StoreEvent(context.Background(), mkev(t, 1, "note", nil))
+		store.StoreEvent(context.Background(), mkev(t, 7, "+", nil))
+	}
+
+	client := dial(t, serve(t, rl))
+	client.send("COUNT", "c", nostr.Filter{Kinds: []int{1}}, nostr.Filter{Kinds: []int{7}})
+	msg, _ := client.until("COUNT")
+	var res struct {
+		Approximate bool `json:"approximate"`
+	}
+	json.Unmarshal(msg[2], &res)
+	if countOf(t, msg) != 5 || !res.Approximate {
+		t.Fatalf("expected an approximate count of 5, got %s", msg)
+	}
+}
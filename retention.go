@@ -0,0 +1,50 @@
+package khatru
+
+import (
+	"cmp"
+	"context"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// how many extra events are fetched (and deleted) in one go when pruning by count
+const retentionPruneBatch = 100
+
+// pruneByCount deletes the oldest events of the same author and kind as the given event
+// such that only the newest RetentionByCount[kind] of them remain.
+func (rl *Relay) pruneByCount(ctx context.Context, evt *nostr.Event) {
+	keep, ok := rl.RetentionByCount[evt.Kind]
+	if !ok || keep <= 0 {
+		return
+	}
+
+	for _, query := range rl.QueryEvents {
+		ch, err := query(ctx, nostr.Filter{
+			Authors: []string{evt.PubKey},
+			Kinds:   []int{evt.Kind},
+			Limit:   keep + retentionPruneBatch,
+		})
+		if err != nil {
+			continue
+		}
+
+		events := make([]*nostr.Event, 0, keep+1)
+		for event := range ch {
+			events = append(events, event)
+		}
+		if len(events) <= keep {
+			continue
+		}
+
+		slices.SortFunc(events, func(a, b *nostr.Event) int {
+			if a.CreatedAt == b.CreatedAt {
+				return cmp.Compare(a.ID, b.ID)
+			}
+			return cmp.Compare(b.CreatedAt, a.CreatedAt)
+		})
+		for _, old := range events[keep:] {
+			rl.deleteEvent(ctx, old)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package khatru
+
+import (
+	"context"
+	"errors"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// QueryRouter dispatches queries to different backends based on the filter, such that, for example,
+// kind-0 can be served from a key-value store while kind-1 is served from a full-text index.
+// Its QueryEvents method can be used directly in Relay.QueryEvents.
+type QueryRouter struct {
+	routes []queryRoute
+
+	// used for the parts of the filter that didn't match any route (optional)
+	Default func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
+}
+
+type queryRoute struct {
+	predicate func(nostr.Filter) bool
+	query     func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
+}
+
+func NewQueryRouter() *QueryRouter {
+	return &QueryRouter{}
+}
+
+// QueryRoute adds a backend that will be used for filters matching the predicate.
+// Routes are checked in the order they were added and the first one that matches wins.
+func (qr *QueryRouter) QueryRoute(
+	predicate func(nostr.Filter) bool,
+	query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error),
+) *QueryRouter {
+	qr.routes = append(qr.routes, queryRoute{predicate, query})
+	return qr
+}
+
+// QueryEvents splits the filter by kind, sends each part to the route that matches it and merges the results,
+// newest first, without duplicates and up to the filter limit. Filters without kinds are sent to all routes that
+// match them. It only returns an error if all the routes failed.
+func (qr *QueryRouter) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	type target struct {
+		query  func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)
+		filter nostr.Filter
+	}
+	targets := make([]target, 0, len(qr.routes)+1)
+
+	if len(filter.Kinds) == 0 {
+		for _, route := range qr.routes {
+			if route.predicate(filter) {
+				targets = append(targets, target{route.query, filter})
+			}
+		}
+		if len(targets) == 0 && qr.Default != nil {
+			targets = append(targets, target{qr.Default, filter})
+		}
+	} else {
+		// group kinds by the route that will handle them (-1 is the default)
+		groups := make(map[int][]int, len(qr.routes)+1)
+		order := make([]int, 0, len(qr.routes)+1)
+		for _, kind := range filter.Kinds {
+			single := filter
+			single.Kinds = []int{kind}
+
+			idx := -1
+			for i, route := range qr.routes {
+				if route.predicate(single) {
+					idx = i
+					break
+				}
+			}
+			if idx == -1 && qr.Default == nil {
+				continue
+			}
+			if _, ok := groups[idx]; !ok {
+				order = append(order, idx)
+			}
+			groups[idx] = append(groups[idx], kind)
+		}
+
+		for _, idx := range order {
+			sub := filter
+			sub.Kinds = groups[idx]
+			if idx == -1 {
+				targets = append(targets, target{qr.Default, sub})
+			} else {
+				targets = append(targets, target{qr.routes[idx].query, sub})
+			}
+		}
+	}
+
+	// a single backend doesn't need merging
+	if len(targets) == 1 {
+		return targets[0].query(ctx, targets[0].filter)
+	}
+
+	results := make([]chan *nostr.Event, 0, len(targets))
+	errs := make([]error, 0, len(targets))
+	for _, t := range targets {
+		res, err := t.query(ctx, t.filter)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		results = append(results, res)
+	}
+	if len(results) == 0 && len(errs) > 0 {
+		// so errors like ErrBackendUnavailable still reach the relay
+		return nil, errors.Join(errs...)
+	}
+
+	ch := make(chan *nostr.Event)
+	go mergeNewestFirst(ctx, results, filter.Limit, ch)
+	return ch, nil
+}
+
+// mergeNewestFirst sends the events from all results to ch, from the newest to the oldest (as long as each of them
+// is sorted like that, as storages return them), without duplicates and at most limit of them if it's set
+func mergeNewestFirst(ctx context.Context, results []chan *nostr.Event, limit int, ch chan *nostr.Event) {
+	defer close(ch)
+	defer func() {
+		// whatever wasn't read is drained so the backends aren't left hanging
+		for _, res := range results {
+			go func(res chan *nostr.Event) {
+				for range res {
+				}
+			}(res)
+		}
+	}()
+
+	heads := make([]*nostr.Event, len(results))
+	next := func(i int) {
+		heads[i] = nil
+		select {
+		case evt, ok := <-results[i]:
+			if ok {
+				heads[i] = evt
+			}
+		case <-ctx.Done():
+		}
+	}
+	for i := range results {
+		next(i)
+	}
+
+	seen := make(map[string]struct{})
+	for sent := 0; limit <= 0 || sent < limit; {
+		newest := -1
+		for i, head := range heads {
+			if head != nil && (newest == -1 || head.CreatedAt > heads[newest].CreatedAt) {
+				newest = i
+			}
+		}
+		if newest == -1 {
+			return
+		}
+
+		evt := heads[newest]
+		next(newest)
+		if _, ok := seen[evt.ID]; ok {
+			continue
+		}
+		seen[evt.ID] = struct{}{}
+		select {
+		case ch <- evt:
+			sent++
+		case <-ctx.Done():
+			return
+		}
+	}
+}
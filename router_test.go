@@ -0,0 +1,88 @@
+package khatru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// sortedBackend returns its events newest first, like a storage would, or always fails with err
+func sortedBackend(events []*nostr.Event, err error) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	store := &memoryStore{}
+	for i := len(events) - 1; i >= 0; i-- {
+		store.StoreEvent(context.Background(), events[i])
+	}
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if err != nil {
+			return nil, err
+		}
+		return store.QueryEvents(ctx, filter)
+	}
+}
+
+func TestQueryRouterMergesNewestFirst(t *testing.T) {
+	var notes, reactions []*nostr.Event
+	for i := 0; i < 10; i++ {
+		// interleaved in time, and stored newest first
+		note := mkev(t, 1, fmt.Sprint(i), nil)
+		note.CreatedAt = nostr.Timestamp(1000 - 2*i)
+		reaction := mkev(t, 7, fmt.Sprint(i), nil)
+		reaction.CreatedAt = nostr.Timestamp(999 - 2*i)
+		notes = append(notes, note)
+		reactions = append(reactions, reaction)
+	}
+	// one event is in both backends
+	shared := mkev(t, 1, "shared", nil)
+	shared.CreatedAt = 2000
+	router := NewQueryRouter().
+		QueryRoute(func(f nostr.Filter) bool { return f.Kinds[0] == 1 }, sortedBackend(append([]*nostr.Event{shared}, notes...), nil))
+	router.Default = sortedBackend(append([]*nostr.Event{shared}, reactions...), nil)
+
+	ch, err := router.QueryEvents(context.Background(), nostr.Filter{Kinds: []int{1, 7}, Limit: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var got []*nostr.Event
+	for evt := range ch {
+		got = append(got, evt)
+	}
+	if len(got) != 10 {
+		t.Fatalf("expected the limit of 10 events, got %d", len(got))
+	}
+	if got[0].ID != shared.ID {
+		t.Fatalf("expected the shared event first")
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].ID == shared.ID || got[i].CreatedAt > got[i-1].CreatedAt {
+			t.Fatalf("events out of order or duplicated at %d: %v", i, got)
+		}
+	}
+}
+
+func TestQueryRouterFailsWhenAllRoutesFail(t *testing.T) {
+	down := fmt.Errorf("replica: %w", ErrBackendUnavailable)
+	router := NewQueryRouter().
+		QueryRoute(func(f nostr.Filter) bool { return f.Kinds[0] == 1 }, sortedBackend(nil, down))
+	router.Default = sortedBackend(nil, errors.New("also down"))
+
+	if _, err := router.QueryEvents(context.Background(), nostr.Filter{Kinds: []int{1, 7}}); !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("expected ErrBackendUnavailable, got %v", err)
+	}
+
+	// only one failing is fine
+	router.Default = sortedBackend([]*nostr.Event{mkev(t, 7, "+", nil)}, nil)
+	ch, err := router.QueryEvents(context.Background(), nostr.Filter{Kinds: []int{1, 7}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != 1 {
+		t.Fatalf("expected the event from the working route, got %d", n)
+	}
+}
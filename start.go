@@ -17,6 +17,10 @@ func (rl *Relay) Router() *http.ServeMux {
 
 // Start creates an http server and starts listening on given host and port.
 func (rl *Relay) Start(host string, port int, started ...chan bool) error {
+	if err := rl.ValidateInfo(); err != nil {
+		return err
+	}
+
 	addr := net.JoinHostPort(host, strconv.Itoa(port))
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -32,6 +36,12 @@ func (rl *Relay) Start(host string, port int, started ...chan bool) error {
 		IdleTimeout:  30 * time.Second,
 	}
 
+	if rl.EnableNIP40 {
+		var ctx context.Context
+		ctx, rl.stopExpirations = context.WithCancel(context.Background())
+		go rl.sweepExpiredEvents(ctx)
+	}
+
 	// notify caller that we're starting
 	for _, started := range started {
 		close(started)
@@ -46,14 +56,53 @@ func (rl *Relay) Start(host string, port int, started ...chan bool) error {
 	}
 }
 
-// Shutdown sends a websocket close control message to all connected clients.
-func (rl *Relay) Shutdown(ctx context.Context) {
-	rl.httpServer.Shutdown(ctx)
+// Shutdown stops accepting new connections, sends a websocket close control message to all connected clients,
+// ends the firehose streams, waits for the goroutines of all of them to finish (or for ctx to be canceled) and
+// then calls the OnShutdown functions (for example, to close the storage). Only the first call does anything,
+// the others return the same result.
+func (rl *Relay) Shutdown(ctx context.Context) error {
+	rl.shutdownOnce.Do(func() {
+		// after this no connection can be registered, the ones being upgraded now are closed by HandleWebsocket
+		rl.shutdownLock.Lock()
+		rl.shuttingDown.Store(true)
+		rl.shutdownLock.Unlock()
+		close(rl.shutdown)
 
-	rl.clients.Range(func(conn *websocket.Conn, _ struct{}) bool {
-		conn.WriteControl(websocket.CloseMessage, nil, time.Now().Add(time.Second))
-		conn.Close()
-		rl.clients.Delete(conn)
-		return true
+		if rl.stopExpirations != nil {
+			rl.stopExpirations()
+		}
+
+		// websockets are closed first, the http server doesn't know about them and would only wait for the
+		// other handlers
+		rl.clients.Range(func(conn *websocket.Conn, _ *WebSocket) bool {
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shutting down"),
+				time.Now().Add(time.Second))
+			conn.Close()
+			return true
+		})
+
+		if rl.httpServer != nil {
+			rl.shutdownErr = rl.httpServer.Shutdown(ctx)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			rl.connections.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			if rl.shutdownErr == nil {
+				rl.shutdownErr = ctx.Err()
+			}
+		}
+
+		for _, onshutdown := range rl.OnShutdown {
+			onshutdown(ctx)
+		}
 	})
+
+	return rl.shutdownErr
 }
@@ -0,0 +1,95 @@
+package khatru
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestShutdownClosesConnectionsBeingUpgraded(t *testing.T) {
+	rl, _ := newTestRelay()
+	upgraded := make(chan struct{})
+	release := make(chan struct{})
+	rl.ResolveConnectionTier = func(r *http.Request) Tier {
+		// this runs after the upgrade and before the connection is registered
+		close(upgraded)
+		<-release
+		return ""
+	}
+	url := serve(t, rl)
+
+	dialed := make(chan *testConn)
+	go func() { dialed <- dial(t, url) }()
+	<-upgraded
+
+	if err := rl.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+	close(release)
+	client := <-dialed
+
+	select {
+	case _, ok := <-client.messages:
+		if ok {
+			t.Fatalf("expected the connection to be closed without any messages")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the connection was left open after Shutdown returned")
+	}
+	if n := rl.OpenConnections(); n != 0 {
+		t.Fatalf("expected no open connections, got %d", n)
+	}
+}
+
+func TestShutdownEndsFirehoseStreams(t *testing.T) {
+	rl, _ := newTestRelay()
+	sk := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(sk)
+	rl.FirehoseAdmins = []string{admin}
+	var openOnShutdown atomic.Int64
+	rl.OnShutdown = append(rl.OnShutdown, func(ctx context.Context) {
+		openOnShutdown.Store(int64(rl.OpenConnections()))
+	})
+
+	started := make(chan bool)
+	go rl.Start("127.0.0.1", 0, started)
+	<-started
+	rl.ServiceURL = "http://" + rl.Addr
+
+	auth := mkev(t, 27235, "", nostr.Tags{{"u", rl.ServiceURL + "/firehose"}, {"method", "GET"}}, sk)
+	b, _ := json.Marshal(auth)
+	req, _ := http.NewRequest("GET", rl.ServiceURL+"/firehose", nil)
+	req.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(b))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to open the firehose: %v %v", err, resp)
+	}
+	defer resp.Body.Close()
+	client := dial(t, "ws://"+rl.Addr)
+	client.send("REQ", "a", nostr.Filter{Kinds: []int{1}})
+	client.until("EOSE")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := rl.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("shutdown took %s", elapsed)
+	}
+	if n := openOnShutdown.Load(); n != 0 {
+		t.Fatalf("OnShutdown was called with %d connections still open", n)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatalf("the firehose stream didn't end cleanly: %s", err)
+	}
+	client.closed(time.Second)
+}
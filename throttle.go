@@ -0,0 +1,112 @@
+package khatru
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DeliveryRate limits how fast live events are sent to a subscription: it can get Burst events at once and
+// then Rate events per second. Events above that are kept in a buffer of up to Buffer events and sent as
+// the rate allows, when the buffer is full they're dropped.
+type DeliveryRate struct {
+	Rate   float64
+	Burst  int
+	Buffer int
+}
+
+// deliveryRate returns the throttle for live events of a subscription created in this context, if any
+func (rl *Relay) deliveryRate(ctx context.Context) *DeliveryRate {
+	if rl.ResolveDeliveryRateLimit != nil {
+		return rl.ResolveDeliveryRateLimit(ctx)
+	}
+	return rl.DeliveryRateLimit
+}
+
+// deliveryThrottle is the token bucket of a single subscription
+type deliveryThrottle struct {
+	rate    DeliveryRate
+	ctx     context.Context // of the connection
+	metrics *Metrics
+
+	mu        sync.Mutex
+	tokens    float64
+	last      time.Time
+	queue     []*nostr.Event
+	scheduled bool
+	stopped   bool
+}
+
+func newDeliveryThrottle(ctx context.Context, rate DeliveryRate, metrics *Metrics) *deliveryThrottle {
+	return &deliveryThrottle{rate: rate, ctx: ctx, metrics: metrics, tokens: float64(max(rate.Burst, 1)), last: time.Now()}
+}
+
+// stop discards the buffer once the subscription is gone, as nobody wants these events anymore
+func (t *deliveryThrottle) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	t.queue = nil
+}
+
+func (t *deliveryThrottle) refill(now time.Time) {
+	t.tokens = min(float64(max(t.rate.Burst, 1)), t.tokens+now.Sub(t.last).Seconds()*t.rate.Rate)
+	t.last = now
+}
+
+// deliver sends the event right away if the rate allows, otherwise it's buffered or dropped.
+// It returns false if the event was dropped.
+func (t *deliveryThrottle) deliver(sub Subscriber, id string, event *nostr.Event) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.refill(time.Now())
+	if len(t.queue) == 0 && t.tokens >= 1 {
+		t.tokens--
+		sub.SendEvent(id, event)
+		return true
+	}
+
+	if len(t.queue) >= t.rate.Buffer {
+		if t.metrics != nil {
+			t.metrics.LiveEventsDropped.Add(1)
+		}
+		return false
+	}
+	t.queue = append(t.queue, event)
+	t.schedule(sub, id)
+	return true
+}
+
+// schedule arranges for the buffer to be flushed when the next token is available, it must be called
+// with the lock held
+func (t *deliveryThrottle) schedule(sub Subscriber, id string) {
+	if t.scheduled || t.rate.Rate <= 0 {
+		return
+	}
+	t.scheduled = true
+	wait := time.Duration((1 - t.tokens) / t.rate.Rate * float64(time.Second))
+	time.AfterFunc(wait, func() { t.flush(sub, id) })
+}
+
+func (t *deliveryThrottle) flush(sub Subscriber, id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.scheduled = false
+
+	if t.stopped || t.ctx.Err() != nil {
+		return
+	}
+
+	t.refill(time.Now())
+	for len(t.queue) > 0 && t.tokens >= 1 {
+		t.tokens--
+		sub.SendEvent(id, t.queue[0])
+		t.queue = t.queue[1:]
+	}
+	if len(t.queue) > 0 {
+		t.schedule(sub, id)
+	}
+}
@@ -0,0 +1,68 @@
+package khatru
+
+import (
+	"sync"
+	"time"
+)
+
+// throughputMeter counts accepted and rejected events in one bucket per second for the last ThroughputWindow
+type throughputMeter struct {
+	mutex   sync.Mutex
+	buckets []throughputBucket
+}
+
+type throughputBucket struct {
+	second   int64
+	accepted int64
+	rejected int64
+}
+
+func (rl *Relay) throughputSeconds() int64 {
+	window := rl.ThroughputWindow
+	if window <= 0 {
+		window = time.Minute
+	}
+	return max(int64(window/time.Second), 1)
+}
+
+func (rl *Relay) recordThroughput(accepted bool) {
+	n := rl.throughputSeconds()
+	now := time.Now().Unix()
+
+	m := &rl.throughput
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if int64(len(m.buckets)) != n {
+		m.buckets = make([]throughputBucket, n)
+	}
+	bucket := &m.buckets[now%n]
+	if bucket.second != now {
+		*bucket = throughputBucket{second: now}
+	}
+	if accepted {
+		bucket.accepted++
+	} else {
+		bucket.rejected++
+	}
+}
+
+// Throughput returns how many events per second AddEvent accepted and rejected on average during the
+// last ThroughputWindow (one minute by default).
+func (rl *Relay) Throughput() (accepted, rejected float64) {
+	n := rl.throughputSeconds()
+	now := time.Now().Unix()
+
+	m := &rl.throughput
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var a, r int64
+	for _, bucket := range m.buckets {
+		if now-bucket.second < n {
+			a += bucket.accepted
+			r += bucket.rejected
+		}
+	}
+	return float64(a) / float64(n), float64(r) / float64(n)
+}
@@ -0,0 +1,107 @@
+package khatru
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const defaultMaxTombstones = 10000
+
+// Tombstone tells an event was deleted by its author with a NIP-09 deletion request. When ServeTombstones is
+// enabled, a REQ that asks by id for events its authenticated client deleted gets, before the EOSE,
+//
+//	["DELETED", <subscription id>, {"id": <event id>, "kind": <kind>, "deletion": <deletion request id>, "deleted_at": <unix timestamp>}]
+//
+// for each of them, with the same subscription id as the REQ. It's never sent to anyone but the author.
+type Tombstone struct {
+	EventID   string          `json:"id"`
+	Kind      int             `json:"kind"`
+	PubKey    string          `json:"-"`
+	DeletedBy string          `json:"deletion"`
+	DeletedAt nostr.Timestamp `json:"deleted_at"`
+}
+
+type tombstoneEnvelope struct {
+	SubscriptionID string
+	Tombstone
+}
+
+func (v tombstoneEnvelope) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]any{"DELETED", v.SubscriptionID, v.Tombstone})
+}
+
+// tombstones remembers the most recent deletions, the oldest are forgotten first
+type tombstones struct {
+	mutex sync.Mutex
+	byID  map[string]Tombstone
+	order []string
+}
+
+func (ts *tombstones) add(t Tombstone, max int) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if ts.byID == nil {
+		ts.byID = make(map[string]Tombstone)
+	}
+	if _, ok := ts.byID[t.EventID]; !ok {
+		ts.order = append(ts.order, t.EventID)
+	}
+	ts.byID[t.EventID] = t
+	for len(ts.order) > max {
+		delete(ts.byID, ts.order[0])
+		ts.order = ts.order[1:]
+	}
+}
+
+// matching returns the tombstones of events by pubkey that the filter asks for by id
+func (ts *tombstones) matching(filter nostr.Filter, pubkey string) []Tombstone {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	var found []Tombstone
+	for _, id := range filter.IDs {
+		t, ok := ts.byID[id]
+		if !ok || t.PubKey != pubkey {
+			continue
+		}
+		if (len(filter.Kinds) > 0 && !slices.Contains(filter.Kinds, t.Kind)) ||
+			(len(filter.Authors) > 0 && !slices.Contains(filter.Authors, t.PubKey)) {
+			continue
+		}
+		found = append(found, t)
+	}
+	return found
+}
+
+func (rl *Relay) addTombstone(target *nostr.Event, deletion *nostr.Event) {
+	max := rl.MaxTombstones
+	if max <= 0 {
+		max = defaultMaxTombstones
+	}
+	rl.tombstones.add(Tombstone{
+		EventID:   target.ID,
+		Kind:      target.Kind,
+		PubKey:    target.PubKey,
+		DeletedBy: deletion.ID,
+		DeletedAt: nostr.Now(),
+	}, max)
+}
+
+// sendTombstones tells the authenticated client about the events it deleted that the filter asks for
+func (rl *Relay) sendTombstones(ctx context.Context, id string, ws jsonWriter, filter nostr.Filter) {
+	if len(filter.IDs) == 0 {
+		return
+	}
+	authed := GetAuthed(ctx)
+	if authed == "" {
+		return
+	}
+	for _, t := range rl.tombstones.matching(filter, authed) {
+		ws.WriteJSON(tombstoneEnvelope{SubscriptionID: id, Tombstone: t})
+	}
+}
@@ -2,6 +2,7 @@ package khatru
 
 import (
 	"context"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/sebest/xff"
@@ -10,10 +11,17 @@ import (
 const (
 	wsKey = iota
 	subscriptionIdKey
+	queryOrderKey
+	storeLatencyKey
+	receivedAtKey
 )
 
+// RequestAuth sends an AUTH challenge to the client. It does nothing for HTTP requests, which can't do NIP-42.
 func RequestAuth(ctx context.Context) {
-	ws := GetConnection(ctx)
+	ws, ok := ctx.Value(wsKey).(*WebSocket)
+	if !ok || ws.conn == nil {
+		return
+	}
 	ws.authLock.Lock()
 	if ws.Authed == nil {
 		ws.Authed = make(chan struct{})
@@ -22,12 +30,75 @@ func RequestAuth(ctx context.Context) {
 	ws.WriteJSON(nostr.AuthEnvelope{Challenge: &ws.Challenge})
 }
 
+// WaitForAuth sends an AUTH challenge to the client if it isn't authenticated yet and waits up to timeout
+// for it to authenticate. It returns the authenticated pubkey, or an empty string if that didn't happen.
+// This is meant to be used by policies that want to give clients a chance to authenticate before rejecting
+// them with "auth-required:".
+func WaitForAuth(ctx context.Context, timeout time.Duration) string {
+	ws, ok := ctx.Value(wsKey).(*WebSocket)
+	if !ok || ws.conn == nil {
+		// not a websocket connection, so it can't do NIP-42
+		return ""
+	}
+	if pubkey := ws.authedPubKey(); pubkey != "" {
+		return pubkey
+	}
+
+	RequestAuth(ctx)
+	ws.authLock.Lock()
+	authed := ws.Authed
+	ws.authLock.Unlock()
+	if authed == nil {
+		// authenticated in the meantime
+		return ws.authedPubKey()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-authed:
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return ws.authedPubKey()
+}
+
+// requestAuthIfNeeded sends an AUTH challenge unless the client is already authenticated or was already
+// challenged and we're waiting for it. It returns false if the client is already authenticated.
+func requestAuthIfNeeded(ctx context.Context, ws *WebSocket) bool {
+	if ws.authedPubKey() != "" {
+		return false
+	}
+	ws.authLock.Lock()
+	pending := ws.Authed != nil
+	ws.authLock.Unlock()
+	if !pending {
+		RequestAuth(ctx)
+	}
+	return true
+}
+
 func GetConnection(ctx context.Context) *WebSocket {
 	return ctx.Value(wsKey).(*WebSocket)
 }
 
+// isFromClient tells if the context comes from a websocket connection rather than from a direct call
+func isFromClient(ctx context.Context) bool {
+	_, ok := ctx.Value(wsKey).(*WebSocket)
+	return ok
+}
+
 func GetAuthed(ctx context.Context) string {
-	return GetConnection(ctx).AuthedPublicKey
+	return GetConnection(ctx).authedPubKey()
+}
+
+// GetTier returns the tier of the connection, as given by ResolveConnectionTier,
+// or an empty tier if the context doesn't come from a connection.
+func GetTier(ctx context.Context) Tier {
+	if ws, ok := ctx.Value(wsKey).(*WebSocket); ok {
+		return ws.Tier
+	}
+	return ""
 }
 
 func GetIP(ctx context.Context) string {
@@ -38,6 +109,26 @@ func GetSubscriptionID(ctx context.Context) string {
 	return ctx.Value(subscriptionIdKey).(string)
 }
 
+// GetReceivedAt returns the time at which the relay received the event being added, such that StoreEvent
+// functions can record it apart from the created_at the author claims. For events sent by clients it's the
+// time the message was read from the connection, for direct calls to AddEvent it's when the call was made.
+// Outside of AddEvent it returns the zero time.
+func GetReceivedAt(ctx context.Context) time.Time {
+	if received, ok := ctx.Value(receivedAtKey).(time.Time); ok {
+		return received
+	}
+	return time.Time{}
+}
+
+// GetQueryOrder returns the order in which a QueryEvents function is expected to return events, as a hint
+// for storages that can pick an index based on it. Outside of a query it returns OrderNewestFirst.
+func GetQueryOrder(ctx context.Context) QueryOrder {
+	if order, ok := ctx.Value(queryOrderKey).(QueryOrder); ok {
+		return order
+	}
+	return OrderNewestFirst
+}
+
 func GetOpenSubscriptions(ctx context.Context) []nostr.Filter {
 	if subs, ok := listeners.Load(GetConnection(ctx)); ok {
 		res := make([]nostr.Filter, 0, listeners.Size()*2)
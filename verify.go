@@ -0,0 +1,84 @@
+package khatru
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SignatureScheme describes a way events can be signed, Detect tells if an event claims to use this scheme
+// (for example, by the sizes of its pubkey and signature) and Verify checks the signature.
+type SignatureScheme struct {
+	Name   string
+	Detect func(evt *nostr.Event) bool
+	Verify func(evt *nostr.Event) (bool, error)
+}
+
+// SchnorrSecp256k1 is the standard nostr signature scheme, the one used when AcceptedSignatureSchemes is empty.
+var SchnorrSecp256k1 = SignatureScheme{
+	Name: "schnorr-secp256k1",
+	Detect: func(evt *nostr.Event) bool {
+		return len(evt.PubKey) == 64 && len(evt.Sig) == 128
+	},
+	Verify: func(evt *nostr.Event) (bool, error) {
+		return evt.CheckSignature()
+	},
+}
+
+type verifyJob struct {
+	event  *nostr.Event
+	result chan string
+}
+
+// verifyEvent checks the event id and signature and returns the reason for an OK message on failure,
+// or an empty string if everything is fine. When VerifyWorkers is set the work is done by a bounded
+// pool of goroutines so signature verification can't take all the CPU.
+func (rl *Relay) verifyEvent(evt *nostr.Event) string {
+	if rl.VerifyWorkers <= 0 {
+		return rl.checkIDAndSignature(evt)
+	}
+
+	rl.verifyPoolOnce.Do(func() {
+		rl.verifyJobs = make(chan verifyJob, rl.VerifyWorkers)
+		for i := 0; i < rl.VerifyWorkers; i++ {
+			go func() {
+				for job := range rl.verifyJobs {
+					job.result <- rl.checkIDAndSignature(job.event)
+				}
+			}()
+		}
+	})
+
+	result := make(chan string, 1)
+	rl.verifyJobs <- verifyJob{evt, result}
+	return <-result
+}
+
+func (rl *Relay) checkIDAndSignature(evt *nostr.Event) string {
+	// check id
+	hash := sha256.Sum256(evt.Serialize())
+	id := hex.EncodeToString(hash[:])
+	if id != evt.ID {
+		return "invalid: id is computed incorrectly"
+	}
+
+	verify := SchnorrSecp256k1.Verify
+	if len(rl.AcceptedSignatureSchemes) > 0 {
+		idx := slices.IndexFunc(rl.AcceptedSignatureSchemes, func(scheme SignatureScheme) bool { return scheme.Detect(evt) })
+		if idx == -1 {
+			return "unsupported: signature scheme not accepted"
+		}
+		verify = rl.AcceptedSignatureSchemes[idx].Verify
+	}
+
+	// check signature
+	if ok, err := verify(evt); err != nil {
+		return "error: failed to verify signature"
+	} else if !ok {
+		return "invalid: signature is invalid"
+	}
+
+	return ""
+}
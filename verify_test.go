@@ -0,0 +1,39 @@
+package khatru
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// BenchmarkWriteThroughput publishes signed events from many goroutines, with signatures verified in the goroutine
+// of each message or by a pool of VerifyWorkers
+func BenchmarkWriteThroughput(b *testing.B) {
+	events := make([]*nostr.Event, 2000)
+	for i := range events {
+		events[i] = mkev(b, 1, strconv.Itoa(i), nil)
+	}
+
+	for _, workers := range []int{0, 1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			rl := NewRelay()
+			rl.VerifyWorkers = workers
+			rl.StoreEvent = append(rl.StoreEvent, func(ctx context.Context, event *nostr.Event) error { return nil })
+			var next atomic.Int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					evt := events[int(next.Add(1))%len(events)]
+					if err := rl.processEvent(context.Background(), evt); err != nil && !HasReasonPrefix(err.Error(), PrefixDuplicate) {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
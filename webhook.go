@@ -0,0 +1,92 @@
+package khatru
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ModerationWebhook describes an external service that gets every incoming event before it is stored
+// and decides if it should be accepted.
+//
+// The event is POSTed as JSON to URL and, if Secret is set, the hex-encoded HMAC-SHA256 of the body is
+// sent in the X-Signature header. The service must answer with {"accept": bool, "reason": string}.
+// If the service can't be reached, takes longer than Timeout or gives an invalid answer the event is
+// accepted or rejected according to AcceptOnFailure.
+type ModerationWebhook struct {
+	URL             string
+	Timeout         time.Duration
+	Secret          string
+	AcceptOnFailure bool
+}
+
+type moderationVerdict struct {
+	Accept bool   `json:"accept"`
+	Reason string `json:"reason"`
+}
+
+// check returns nil if the event was accepted by the webhook, or an error with a prefixed reason.
+func (mw *ModerationWebhook) check(ctx context.Context, evt *nostr.Event) error {
+	verdict, err := mw.ask(ctx, evt)
+	if err != nil {
+		if mw.AcceptOnFailure {
+			return nil
+		}
+		return errors.New("error: moderation service unavailable")
+	}
+
+	if !verdict.Accept {
+		if verdict.Reason == "" {
+			return errors.New("blocked: rejected by moderation")
+		}
+		return errors.New(nostr.NormalizeOKMessage(verdict.Reason, "blocked"))
+	}
+	return nil
+}
+
+func (mw *ModerationWebhook) ask(ctx context.Context, evt *nostr.Event) (moderationVerdict, error) {
+	var verdict moderationVerdict
+
+	body, err := json.Marshal(evt)
+	if err != nil {
+		return verdict, err
+	}
+
+	timeout := mw.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, mw.URL, bytes.NewReader(body))
+	if err != nil {
+		return verdict, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if mw.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(mw.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return verdict, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return verdict, errors.New("moderation webhook returned " + resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&verdict)
+	return verdict, err
+}
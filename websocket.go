@@ -1,10 +1,19 @@
 package khatru
 
 import (
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/puzpuzpuz/xsync/v3"
 )
 
 type WebSocket struct {
@@ -14,22 +23,204 @@ type WebSocket struct {
 	// original request
 	Request *http.Request
 
+	// negotiated websocket subprotocol, if any
+	Subprotocol string
+
+	// features negotiated through the X-Nostr-Features header
+	features []string
+
+	// messages smaller than this are not compressed, see CompressionMinSize
+	compressionMinSize int
+
+	// set when the client negotiated CompressionDictionaryFeature
+	dictionary *CompressionDictionary
+
+	// set when the client negotiated AttestationFeature
+	attester *attester
+
+	// set when MaxTotalOutgoingBytes is enabled
+	outgoing     *outgoingLimiter
+	pendingBytes atomic.Int64
+
+	// set when WriteQueueSize is enabled, messages are written by the goroutine that sends pings
+	queue       chan queuedMessage
+	queueMutex  sync.Mutex
+	queueClosed bool
+	evictOnce   sync.Once
+
+	// NIP-77 sessions opened by the client, if EnableNegentropy is set
+	negentropy *xsync.MapOf[string, *negentropySession]
+
+	// access tier given by ResolveConnectionTier, if any
+	Tier Tier
+
 	// nip42
 	Challenge       string
 	AuthedPublicKey string
 	Authed          chan struct{}
 
+	authAttempts int
+
 	authLock sync.Mutex
+
+	// for MaxSubscriptionChurn
+	churn        float64
+	churnUpdated time.Time
+	churnLock    sync.Mutex
+
+	// unix timestamp of the last message received from the client
+	lastActivity atomic.Int64
+
+	drainOnce sync.Once
+}
+
+// Tier is an access level for connections, for example one for each API plan of a commercial relay.
+// It is assigned by ResolveConnectionTier when the connection is established.
+type Tier string
+
+// authedPubKey returns AuthedPublicKey, it must be used instead of reading the field directly
+// whenever the connection is already being handled since the field is set concurrently by AUTH
+func (ws *WebSocket) authedPubKey() string {
+	ws.authLock.Lock()
+	defer ws.authLock.Unlock()
+	return ws.AuthedPublicKey
 }
 
+// HasFeature tells if the given feature was declared by the client and is supported by the relay.
+func (ws *WebSocket) HasFeature(name string) bool {
+	return slices.Contains(ws.features, strings.ToLower(name))
+}
+
+// errNoConnection is returned when writing to the WebSocket given to policies for HTTP requests, which has no
+// connection behind it
+var errNoConnection = errors.New("not a websocket connection")
+
 func (ws *WebSocket) WriteJSON(any any) error {
+	if ws.conn == nil {
+		return errNoConnection
+	}
+	err := ws.writeJSON(any)
+
+	// events are followed by their attestation
+	if env, ok := any.(nostr.EventEnvelope); ok && ws.attester != nil && err == nil && env.SubscriptionID != nil {
+		att, err := ws.attester.attest(*env.SubscriptionID, env.Event.ID)
+		if err != nil {
+			return err
+		}
+		return ws.writeJSON(att)
+	}
+	return err
+}
+
+func (ws *WebSocket) writeJSON(any any) error {
+	if ws.dictionary != nil || ws.outgoing != nil || ws.queue != nil || ws.compressionMinSize > 0 {
+		j, err := json.Marshal(any)
+		if err != nil {
+			return err
+		}
+		if ws.dictionary != nil {
+			return ws.WriteMessage(websocket.BinaryMessage, ws.dictionary.compress(j))
+		}
+		return ws.WriteMessage(websocket.TextMessage, j)
+	}
+
 	ws.mutex.Lock()
 	defer ws.mutex.Unlock()
 	return ws.conn.WriteJSON(any)
 }
 
 func (ws *WebSocket) WriteMessage(t int, b []byte) error {
+	if ws.conn == nil {
+		return errNoConnection
+	}
+	if ws.queue != nil {
+		return ws.enqueue(queuedMessage{t, b})
+	}
+
+	if ws.outgoing != nil {
+		ws.outgoing.queued(ws, len(b))
+	}
+	return ws.write(t, b)
+}
+
+// write sends a message to the client right away
+func (ws *WebSocket) write(t int, b []byte) error {
+	if ws.outgoing != nil {
+		defer ws.outgoing.sent(ws, len(b))
+	}
+
 	ws.mutex.Lock()
 	defer ws.mutex.Unlock()
+	if ws.compressionMinSize > 0 {
+		ws.conn.EnableWriteCompression(len(b) >= ws.compressionMinSize)
+	}
 	return ws.conn.WriteMessage(t, b)
 }
+
+type queuedMessage struct {
+	typ  int
+	data []byte
+}
+
+var errWriteQueueFull = errors.New("write queue full")
+
+// enqueue adds a message to the write queue without ever blocking, if the queue is full the client
+// isn't reading fast enough so the connection is closed instead.
+func (ws *WebSocket) enqueue(msg queuedMessage) error {
+	ws.queueMutex.Lock()
+	if ws.queueClosed {
+		ws.queueMutex.Unlock()
+		return net.ErrClosed
+	}
+	select {
+	case ws.queue <- msg:
+		if ws.outgoing != nil {
+			ws.outgoing.queued(ws, len(msg.data))
+		}
+		ws.queueMutex.Unlock()
+		return nil
+	default:
+		ws.queueMutex.Unlock()
+	}
+
+	ws.evictOnce.Do(func() {
+		// the close frame may take a while to go through, but whoever is writing can't be held
+		go func() {
+			ws.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "not reading fast enough"),
+				time.Now().Add(time.Second))
+			ws.conn.Close()
+		}()
+	})
+	return errWriteQueueFull
+}
+
+// closeQueue discards the messages still in the write queue and makes further writes fail,
+// it's called when the goroutine that writes them is exiting.
+func (ws *WebSocket) closeQueue() {
+	ws.queueMutex.Lock()
+	defer ws.queueMutex.Unlock()
+	ws.queueClosed = true
+	for {
+		select {
+		case msg := <-ws.queue:
+			if ws.outgoing != nil {
+				ws.outgoing.sent(ws, len(msg.data))
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (ws *WebSocket) SendEvent(subID string, event *nostr.Event) error {
+	return ws.WriteJSON(nostr.EventEnvelope{SubscriptionID: &subID, Event: *event})
+}
+
+func (ws *WebSocket) SendEOSE(subID string) error {
+	return ws.WriteJSON(nostr.EOSEEnvelope(subID))
+}
+
+func (ws *WebSocket) SendClosed(subID string, reason string) error {
+	return ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: subID, Reason: reason})
+}
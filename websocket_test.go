@@ -0,0 +1,108 @@
+package khatru
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCompressedAndUncompressedClientsGetTheSameEvents(t *testing.T) {
+	rl, store := newTestRelay()
+	rl.EnableCompression = true
+	stored := mkev(t, 1, strings.Repeat("stored ", 200), nil)
+	store.StoreEvent(context.Background(), stored)
+	url := serve(t, rl)
+
+	compressed, resp := dialWith(t, &websocket.Dialer{EnableCompression: true}, url)
+	if !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Fatalf("compression wasn't negotiated")
+	}
+	plain, resp := dialWith(t, &websocket.Dialer{}, url)
+	if resp.Header.Get("Sec-Websocket-Extensions") != "" {
+		t.Fatalf("compression was negotiated with a client that didn't ask for it")
+	}
+
+	received := make([][][]byte, 2)
+	for i, client := range []*testConn{compressed, plain} {
+		client.send("REQ", "a", nostr.Filter{Kinds: []int{1}})
+		_, before := client.until("EOSE")
+		for _, msg := range before {
+			received[i] = append(received[i], msg[2])
+		}
+	}
+
+	publisher := dial(t, url)
+	publisher.send("EVENT", mkev(t, 1, strings.Repeat("live ", 200), nil))
+	publisher.until("OK")
+	for i, client := range []*testConn{compressed, plain} {
+		msg, _ := client.until("EVENT")
+		received[i] = append(received[i], msg[2])
+	}
+
+	if len(received[0]) != 2 || len(received[1]) != 2 {
+		t.Fatalf("expected 2 events for each client, got %d and %d", len(received[0]), len(received[1]))
+	}
+	for i := range received[0] {
+		if !bytes.Equal(received[0][i], received[1][i]) {
+			t.Fatalf("the clients got different events:\n%s\n%s", received[0][i], received[1][i])
+		}
+	}
+	var first nostr.Event
+	if err := json.Unmarshal(received[0][0], &first); err != nil || first.ID != stored.ID {
+		t.Fatalf("unexpected stored event %s", received[0][0])
+	}
+}
+
+func TestStalledReaderDoesntBlockBroadcasts(t *testing.T) {
+	rl, _ := newTestRelay()
+	rl.WriteQueueSize = 16
+	url := serve(t, rl)
+
+	// this one never reads anything
+	stalled, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	stalled.WriteJSON([]any{"REQ", "a", nostr.Filter{Kinds: []int{1}}})
+
+	healthy := dial(t, url)
+	healthy.send("REQ", "a", nostr.Filter{Kinds: []int{1}})
+	healthy.until("EOSE")
+	waitFor(t, "subscriptions", func() bool { return rl.ActiveSubscriptions() == 2 })
+
+	const n = 500
+	content := strings.Repeat("x", 32*1024)
+	events := make([]*nostr.Event, n)
+	for i := range events {
+		events[i] = &nostr.Event{ID: fmt.Sprintf("%064x", i), Kind: 1, Content: content, CreatedAt: nostr.Now()}
+	}
+
+	// each broadcast must reach the healthy client right away, even once the stalled one stops taking anything
+	for i, evt := range events {
+		broadcasted := make(chan struct{})
+		go func() {
+			rl.BroadcastEvent(evt)
+			close(broadcasted)
+		}()
+		select {
+		case <-broadcasted:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("broadcasting got stuck at event %d", i)
+		}
+		msg, _ := healthy.until("EVENT")
+		if got := messageEvent(t, msg); got.ID != evt.ID {
+			t.Fatalf("expected event %d, got %s", i, got.ID)
+		}
+	}
+
+	// and the stalled client was dropped
+	waitFor(t, "eviction", func() bool { return rl.OpenConnections() == 1 })
+}